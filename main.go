@@ -1,566 +1,1760 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
+
+	"github.com/nma/dankfolio/backend/cmd/trim-mainnet/pooltrim"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	rpcEndpoint      = "https://solana-mainnet.rpcpool.com"
-	defaultQuoteMint = "So11111111111111111111111111111111111111112" // SOL
 	outputFile       = "trimmed_mainnet.json"
-	raydiumURL       = "https://api.raydium.io/v2/sdk/liquidity/mainnet.json"
-	raydiumTokensURL = "https://api.raydium.io/v2/sdk/token/raydium.mainnet.json"
+	csvOutputFile    = "trimmed_mainnet.csv"
+	ndjsonOutputFile = "trimmed_mainnet.ndjson"
 )
 
-// RaydiumPool represents a Raydium liquidity pool
-type RaydiumPool struct {
-	ID              string `json:"id"`
-	BaseMint        string `json:"baseMint"`
-	QuoteMint       string `json:"quoteMint"`
-	LPMint          string `json:"lpMint"`
-	ProgramID       string `json:"programId"`
-	Authority       string `json:"authority"`
-	OpenOrders      string `json:"openOrders"`
-	TargetOrders    string `json:"targetOrders"`
-	BaseVault       string `json:"baseVault"`
-	QuoteVault      string `json:"quoteVault"`
-	Version         int    `json:"version"`
-	BaseDecimals    int    `json:"baseDecimals"`
-	QuoteDecimals   int    `json:"quoteDecimals"`
-	LPDecimals      int    `json:"lpDecimals"`
-	MarketVersion   int    `json:"marketVersion"`
-	MarketProgramID string `json:"marketProgramId"`
-	MarketID        string `json:"marketId"`
-}
-
-// RaydiumResponse represents the API response structure
-type RaydiumResponse struct {
-	Name       string        `json:"name"`
-	Official   []RaydiumPool `json:"official"`
-	Unofficial []RaydiumPool `json:"unOfficial"`
+// version identifies the build in --version, the default User-Agent and the
+// output metadata. Release builds set it at link time with
+// -ldflags "-X main.version=$(git describe --tags --always --dirty)"
+var version = "dev"
+
+// resolveVersion returns version, falling back to the module version or VCS
+// revision recorded by go build when it was not set at link time
+func resolveVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if version != "dev" || !ok {
+		return version
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	var revision string
+	var dirty bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			dirty = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return version
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if dirty {
+		revision += "-dirty"
+	}
+	return "dev-" + revision
 }
 
-// Config holds the program configuration
-type Config struct {
-	inputFile string
-	tokenFile string
-	mint      string // Single mint flag for specifying token address
-	ticker    string // Added ticker field
+// Exit codes that let scripts tell failures apart. Any other failure exits
+// with exitFailure
+const (
+	exitFailure    = 1
+	exitUsage      = 2 // Bad flags, config file or environment
+	exitDownload   = 3 // The pool or token list could not be downloaded, or the reserves fetched
+	exitValidation = 4 // The pool or token list is malformed or fails its checksum, or the output file is corrupt
+	exitNotFound   = 5 // A requested token is not in the token list or not stored in the output file
+	exitNoPools    = 6 // No pools matched, with --fail-on-empty or --market-id
+)
+
+// fatalf logs the message like log.Fatalf and exits with the given code
+func fatalf(code int, format string, args ...any) {
+	log.Printf(format, args...)
+	os.Exit(code)
 }
 
-// TokenInfo represents a token in Raydium's token list
-type TokenInfo struct {
-	Symbol   string `json:"symbol"`
-	Name     string `json:"name"`
-	Mint     string `json:"mint"`
-	Decimals int    `json:"decimals"`
+// failureCode returns the exit code for a failure to fetch or read the pool
+// or token list
+func failureCode(err error) int {
+	var download *pooltrim.DownloadError
+	var validation *pooltrim.ValidationError
+	switch {
+	case errors.As(err, &download):
+		return exitDownload
+	case errors.As(err, &validation):
+		return exitValidation
+	}
+	return exitFailure
 }
 
-// TokenListResponse represents the token list API response
-type TokenListResponse struct {
-	Official   []TokenInfo `json:"official"`
-	Unofficial []TokenInfo `json:"unOfficial"`
+// outputFailureCode returns the exit code for a failure to read or update
+// an output file
+func outputFailureCode(err error) int {
+	var corrupt *pooltrim.CorruptOutputError
+	switch {
+	case errors.As(err, &corrupt):
+		return exitValidation
+	case errors.Is(err, pooltrim.ErrTokenNotStored):
+		return exitNotFound
+	case errors.Is(err, fs.ErrNotExist):
+		return exitUsage
+	}
+	return exitFailure
 }
 
-// TokenPoolInfo combines token information with its pools
-type TokenPoolInfo struct {
-	Token TokenInfo     `json:"token"`
-	Pools []RaydiumPool `json:"pools"`
+// Config holds the program configuration
+type Config struct {
+	inputFile        string     // First of inputFiles
+	inputFiles       stringList // Pool files given with --file
+	fileWorkers      int        // Pool files scanned at the same time
+	tokenFile        string
+	mint             string // Single mint flag for specifying token address
+	ticker           string // Added ticker field, may be a comma-separated list
+	quoteMint        string // Quote side of the pair, defaults to SOL, may be a comma-separated list
+	quoteTicker      string // Quote symbol resolved via the token list
+	watchlist        string // File with one ticker or mint per line
+	lookupMint       string // Mint resolved to its ticker via the token list
+	exact            bool   // Match ticker symbols exactly, without suggestions
+	name             string // Substring searched for in token names
+	interactive      bool   // Prompt for a choice when a symbol is ambiguous
+	format           string // Output format, json, csv or ndjson
+	stdout           bool   // Write results to stdout instead of a file
+	compact          bool   // Write JSON on a single line instead of indented
+	fields           string // Comma-separated pool fields kept in the output
+	appendOnly       bool   // Never replace existing output entries
+	force            bool   // Replace the output file instead of merging into it
+	recover          bool   // Move a corrupt output file aside instead of failing
+	output           string // Output file path, "-" for stdout
+	httpTimeout      time.Duration
+	userAgent        string
+	proxy            string // Proxy URL for every request, overriding the proxy environment variables
+	tmpDir           string // Directory for downloads when the cache is off
+	skipSpaceCheck   bool
+	deadline         time.Duration // Limit for the whole run, 0 means none
+	progressInterval int
+	progress         string
+	statsJSON        string
+	bench            bool   // Print the wall-clock time of each phase
+	count            bool   // Only count the pools of the pool list
+	benchJSON        string // File the phase timings are written to as JSON
+	metricsFile      string
+	marketID         string
+	anyQuote         bool
+	splitOutput      string // Directory for one file per token entry
+	mergeFrom        string // Output file whose entries are merged into ours
+	flatOutput       bool   // Write a plain array of pools instead of the token list
+	flatSymbol       bool   // Add a tokenSymbol field to each flat pool
+	diffOld          string // Older output file compared against diffNew
+	diffNew          string // Newer output file, the argument after --diff
+	diffFormat       string // text or json
+	decimals         int    // Decimals of a direct mint, negative when not given
+	maxRetries       int
+	sha256           string // Expected SHA-256 of the downloaded pool file
+	offline          bool   // Fail instead of downloading anything
+	cacheTTL         time.Duration
+	refresh          bool   // Ignore cached downloads
+	ifNoneMatch      bool   // Revalidate expired cached downloads instead of downloading them again
+	clean            bool   // Remove downloaded files and exit
+	versions         string // Comma-separated pool versions to keep
+	minVersion       int    // Lowest pool version to keep
+	minDecimals      int
+	maxDecimals      int  // Zero means no upper bound
+	official         bool // Only scan official pools
+	unofficial       bool // Only scan unofficial pools
+	programIDs       stringList
+	marketProgramIDs stringList
+	marketVersions   string // Comma-separated market versions to keep
+	workers          int    // Goroutines decoding pools
+	withReserves     bool   // Fetch vault balances over RPC
+	rpcURL           string
+	rpcBatchSize     int
+	rpcRate          float64 // RPC batches per second
+	rpcConcurrency   int     // RPC batches in flight at once
+	reservesTTL      time.Duration
+	refreshReserves  bool
+	minLiquidity     float64 // Minimum quote-side reserve, implies withReserves
+	withPrice        bool    // Derive spot prices from reserves, implies withReserves
+	sortBy           string  // Pool field the output is sorted by
+	limit            int     // Maximum pools kept per token, 0 keeps all
+	top              int     // Maximum pools kept across all tokens by quote reserve, 0 keeps all
+	sortDesc         bool
+	failOnEmpty      bool   // Exit nonzero when a token has no pools
+	dryRun           bool   // Report the changes without writing the output
+	summaryOnly      bool   // Only print the pool summary, without reading or writing the output
+	backup           bool   // Copy the existing output to a .bak file first
+	remove           string // Ticker whose entries are removed from the output
+	list             bool   // Print a summary of the output file
+	query            string // Ticker whose stored entries are printed
+	strictValidate   bool   // Check every pool for missing required fields
+	logLevel         string // Minimum level of log messages
+	quiet            bool   // Only log errors
+	verbose          bool   // Log debug messages, including full pool details
+	jsonLogs         bool   // Log one JSON object per line to stderr
+	configFile       string // YAML file with default flag values
+	showVersion      bool   // Print the version and exit
+	keepUnknown      bool   // Write pool fields RaydiumPool does not know about back unchanged
+	strictSchema     bool   // Fail on pool and token fields the tool does not know about
+	skipBadPools     bool   // Skip pools that fail to decode instead of aborting
+	maxUnofficial    int    // Unofficial pools scanned before stopping, 0 scans all
+	poolURL          string
+	tokensURL        string
+	maxInvalidRatio  float64
 }
 
-// TokenPoolInfoList represents a list of token and pool information
-type TokenPoolInfoList struct {
-	Tokens []TokenPoolInfo `json:"tokens"`
+// stringList is a flag value collecting repeated or comma-separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, splitList(value)...)
+	return nil
 }
 
 // parseFlags parses command line flags and returns config
 func parseFlags() Config {
 	var config Config
+	version = resolveVersion()
 
-	flag.StringVar(&config.inputFile, "file", "", "Path to existing pool JSON file (optional)")
+	flag.Var(&config.inputFiles, "file", "Path to existing pool JSON file, or - to read it from stdin. Repeatable or comma-separated to filter several snapshots (optional)")
+	flag.IntVar(&config.fileWorkers, "file-workers", 2, "Pool files scanned at the same time when several --file are given")
 	flag.StringVar(&config.tokenFile, "token-file", "", "Path to existing token list JSON file (optional)")
 	flag.StringVar(&config.mint, "mint", "", "Token mint address (optional, requires --ticker)")
-	flag.StringVar(&config.ticker, "ticker", "", "Token ticker symbol (required when using --mint)")
+	flag.IntVar(&config.decimals, "decimals", -1, "Decimals of the token given with --mint (default 9)")
+	flag.StringVar(&config.ticker, "ticker", "", "Token ticker symbol, or a comma-separated list of symbols (required when using --mint)")
+	flag.StringVar(&config.quoteMint, "quote-mint", "", "Quote token mint address, or a comma-separated list to match any of them (optional, defaults to SOL)")
+	flag.StringVar(&config.watchlist, "watchlist", "", "Path to a file with one ticker or mint address per line (optional)")
+	flag.StringVar(&config.lookupMint, "lookup-mint", "", "Token mint address whose ticker is looked up in the token list (optional)")
+	flag.StringVar(&config.name, "name", "", "Search the token list for names containing this substring, ignoring case (optional)")
+	flag.BoolVar(&config.interactive, "interactive", false, "Prompt for a choice on stdin when several tokens match, instead of exiting")
+	flag.BoolVar(&config.exact, "exact", false, "Match ticker symbols exactly instead of ignoring case and suggesting similar symbols")
+	flag.BoolVar(&config.anyQuote, "any-quote", false, "Keep every pool of the base tokens whatever the quote token, instead of only pairs with the quote")
+	flag.StringVar(&config.quoteTicker, "quote-ticker", "", "Quote token ticker symbol resolved via the token list (optional)")
+	flag.StringVar(&config.format, "format", "json", "Output format: json, csv or ndjson")
+	flag.BoolVar(&config.stdout, "stdout", false, "Write results to stdout and send logs to stderr")
+	flag.BoolVar(&config.compact, "compact", false, "Write output JSON on a single line instead of indented")
+	flag.BoolVar(&config.force, "force", false, "Replace the output file with only this run's entries instead of merging into it")
+	flag.BoolVar(&config.recover, "recover", false, "Move an output file that cannot be parsed to <output>.corrupt and start a fresh one")
+	flag.BoolVar(&config.appendOnly, "append-only", false, "Only add new tokens to the output file, keeping existing entries untouched")
+	flag.StringVar(&config.fields, "fields", "", "Comma-separated pool fields to keep in the output, such as id,baseVault,quoteVault (default all)")
+	flag.BoolVar(&config.keepUnknown, "keep-unknown-fields", false, "Preserve pool fields this version does not know about in JSON and NDJSON output")
+	flag.BoolVar(&config.skipBadPools, "skip-bad-pools", false, "Log and skip pools that fail to decode instead of aborting the scan, and report how many were skipped")
+	flag.BoolVar(&config.strictSchema, "strict-schema", false, "Fail on the first pool or token with a field this version does not know about, to detect upstream format changes")
+	flag.StringVar(&config.tmpDir, "tmp-dir", os.TempDir(), "Directory for downloaded files when the cache is disabled, created if missing")
+	flag.BoolVar(&config.skipSpaceCheck, "skip-space-check", false, "Download even when the Content-Length exceeds the free space of the target directory")
+	flag.DurationVar(&config.httpTimeout, "http-timeout", 5*time.Minute, "Timeout for each HTTP download, 0 disables it")
+	flag.StringVar(&config.proxy, "proxy", "", "Proxy URL for downloads and RPC requests, e.g. http://proxy:3128. Defaults to HTTP_PROXY, HTTPS_PROXY and NO_PROXY")
+	flag.StringVar(&config.userAgent, "user-agent", "raydium-pool-trim/"+version, "User-Agent header sent with downloads")
+	flag.DurationVar(&config.deadline, "deadline", 0, "Abort the whole run, including downloads, parsing and RPC calls, after this long, 0 disables it")
+	flag.IntVar(&config.maxRetries, "max-retries", 3, "Number of times to retry a failed download or a rate limited RPC batch")
+	flag.StringVar(&config.sha256, "expected-sha256", "", "Expected SHA-256 hex digest of the downloaded pool file (optional)")
+	flag.BoolVar(&config.offline, "offline", false, "Never download; fail if the pool file or token list is not provided")
+	flag.DurationVar(&config.cacheTTL, "cache-ttl", time.Hour, "How long downloaded files are reused from the cache, 0 disables caching")
+	flag.BoolVar(&config.refresh, "refresh", false, "Force a fresh download even if a cached file is available")
+	flag.BoolVar(&config.ifNoneMatch, "if-none-match", false, "Ask the server whether an expired cached download changed, using its stored ETag and Last-Modified, and reuse it when it did not")
+	flag.BoolVar(&config.clean, "clean", false, "Remove downloaded pool and token files from the tmp-dir and cache directories, then exit")
+	flag.StringVar(&config.versions, "pool-version", "", "Only keep pools with these Raydium versions, comma-separated (optional)")
+	flag.IntVar(&config.minVersion, "min-version", 0, "Skip pools with a lower Raydium version, combines with --pool-version")
+	flag.IntVar(&config.minDecimals, "min-decimals", 0, "Skip pools whose base token has fewer decimals")
+	flag.IntVar(&config.maxDecimals, "max-decimals", 0, "Skip pools whose base token has more decimals, 0 disables the check")
+	flag.BoolVar(&config.official, "official-only", false, "Only scan the official pools")
+	flag.BoolVar(&config.unofficial, "unofficial-only", false, "Only scan the unofficial pools")
+	flag.IntVar(&config.maxUnofficial, "max-unofficial", 0, "Stop scanning the unofficial pools after this many, for quick partial runs. 0 scans all")
+	flag.Var(&config.programIDs, "program-id", "Only keep pools owned by this AMM program, repeatable or comma-separated (optional)")
+	flag.Var(&config.marketProgramIDs, "market-program-id", "Only keep pools whose market is owned by this program, repeatable or comma-separated (optional)")
+	flag.StringVar(&config.marketID, "market-id", "", "Only keep the pool on this market; on its own, look up the pool on the market whatever its mints (optional)")
+	flag.StringVar(&config.marketVersions, "market-version", "", "Only keep pools with these market versions, comma-separated (optional)")
+	flag.IntVar(&config.progressInterval, "progress-interval", 100000, "Number of pools between parsing progress updates, 0 disables them")
+	flag.IntVar(&config.workers, "workers", runtime.GOMAXPROCS(0), "Number of goroutines decoding pools, 1 decodes serially")
+	flag.BoolVar(&config.withReserves, "with-reserves", false, "Fetch the base and quote vault balances of each pool over RPC")
+	flag.Float64Var(&config.minLiquidity, "min-liquidity-sol", 0, "Skip pools whose SOL (or other quote token) reserve is below this amount, implies --with-reserves")
+	flag.BoolVar(&config.withPrice, "with-price", false, "Add an approximate spot price in quote tokens per base token to each pool, implies --with-reserves")
+	flag.StringVar(&config.poolURL, "pool-url", pooltrim.RaydiumURL, "URL of the Raydium pool list, e.g. a mirror or a pinned snapshot")
+	flag.StringVar(&config.tokensURL, "tokens-url", pooltrim.RaydiumTokensURL, "URL of the Raydium token list")
+	flag.StringVar(&config.rpcURL, "rpc-url", rpcEndpoint, "Solana JSON-RPC endpoint used by --with-reserves")
+	flag.IntVar(&config.rpcBatchSize, "rpc-batch-size", 100, "Number of vault accounts fetched per RPC batch")
+	flag.DurationVar(&config.reservesTTL, "reserves-ttl", 5*time.Minute, "How long vault balances fetched over RPC are reused from the cache, 0 disables caching")
+	flag.BoolVar(&config.refreshReserves, "refresh-reserves", false, "Fetch every vault balance over RPC even if a cached value is available")
+	flag.IntVar(&config.rpcConcurrency, "rpc-concurrency", 1, "Number of RPC batches in flight at once, still bounded by --rpc-rate")
+	flag.Float64Var(&config.rpcRate, "rpc-rate", 5, "Maximum RPC batches sent per second, 0 disables the limit")
+	flag.StringVar(&config.sortBy, "sort-by", "", "Sort each token's pools by version, baseDecimals, liquidity or price (optional)")
+	flag.IntVar(&config.top, "top", 0, "Keep only the N pools with the deepest quote reserve across all tokens, ranked in a single list, implies --with-reserves and needs a single quote token, 0 keeps all")
+	flag.IntVar(&config.limit, "limit", 0, "Keep at most this many pools per token after sorting, 0 keeps all")
+	flag.BoolVar(&config.sortDesc, "sort-desc", false, "Sort in descending order")
+	flag.BoolVar(&config.failOnEmpty, "fail-on-empty", false, "Exit with a nonzero status when any requested token has no matching pools")
+	flag.BoolVar(&config.dryRun, "dry-run", false, "Report which entries would be inserted or updated without writing the output")
+	flag.BoolVar(&config.summaryOnly, "summary-only", false, "Only print the pool summary and match counts, without comparing against or writing the output")
+	flag.BoolVar(&config.backup, "backup", false, "Copy the existing output file to <output>.bak before overwriting it")
+	flag.StringVar(&config.mergeFrom, "merge-from", "", "Upsert the entries of another output file into the output file, then exit")
+	flag.StringVar(&config.remove, "remove", "", "Remove the entries for this ticker from the output file, then exit")
+	flag.BoolVar(&config.flatOutput, "flat-output", false, "Write the pools as a plain JSON array instead of the token list, replacing the output file")
+	flag.BoolVar(&config.flatSymbol, "flat-symbol", false, "Add a tokenSymbol field to each pool of --flat-output")
+	flag.StringVar(&config.diffOld, "diff", "", "Compare this output file against the one given after it, e.g. --diff old.json new.json, and report added, removed and changed pools per token, then exit")
+	flag.StringVar(&config.diffFormat, "diff-format", "text", "Format of the --diff report: text or json")
+	flag.BoolVar(&config.list, "list", false, "Print the symbol, mint and pool count of each entry in the output file, then exit")
+	flag.StringVar(&config.query, "query", "", "Print the stored entries for this ticker from the output file as JSON, then exit")
+	flag.BoolVar(&config.strictValidate, "strict-validate", false, "Check every pool for missing id, mint and vault fields")
+	flag.Float64Var(&config.maxInvalidRatio, "max-invalid-ratio", 0.01, "Share of incomplete pools above which --strict-validate fails instead of warning")
+	flag.StringVar(&config.logLevel, "log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	flag.BoolVar(&config.verbose, "verbose", false, "Log the full details of every matched pool and other debug messages, same as --log-level=debug")
+	flag.BoolVar(&config.quiet, "quiet", false, "Only log errors, including no progress output")
+	flag.StringVar(&config.progress, "progress", "", "Progress style: bar, plain or none (default bar on a terminal, plain otherwise)")
+	flag.BoolVar(&config.count, "count", false, "Only count the official and unofficial pools of the pool list, then exit")
+	flag.BoolVar(&config.bench, "bench", false, "Print the wall-clock time spent in token resolution, download, validation, pool scanning, RPC and writing")
+	flag.StringVar(&config.benchJSON, "bench-json", "", "Write the time spent in each phase to this JSON file (optional)")
+	flag.StringVar(&config.statsJSON, "stats-json", "", "Write bytes read, pool counts, matches, elapsed time and throughput of the scan to this JSON file (optional)")
+	flag.StringVar(&config.metricsFile, "metrics-file", "", "Write Prometheus textfile collector metrics to this file after a successful run (optional)")
+	flag.BoolVar(&config.jsonLogs, "json-logs", false, "Write log messages to stderr as one JSON object per line")
+	flag.StringVar(&config.splitOutput, "split-output", "", "Also write one <symbol>.json file per token to this directory (optional)")
+	flag.StringVar(&config.output, "output", "", "Output file path, or - for stdout (default trimmed_mainnet.json, or trimmed_mainnet.csv/.ndjson with --format=csv/ndjson)")
+
+	flag.StringVar(&config.configFile, "config", "", "Path to a YAML file with default flag values, overridden by command line flags (optional)")
+	flag.BoolVar(&config.showVersion, "version", false, "Print the version and exit")
 
 	flag.Parse()
 
-	return config
-}
+	if config.showVersion {
+		fmt.Println("raydium-pool-trim", version)
+		os.Exit(0)
+	}
 
-// fileExists checks if a file exists
-func fileExists(path string) bool {
-	_, err := os.Stat(path)
-	return !os.IsNotExist(err)
-}
+	// Flags given on the command line win over the config file and environment
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
 
-// downloadFile downloads a file and shows progress
-func downloadFile(url, tempFilePath string) error {
-	// Create the file
-	out, err := os.Create(tempFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+	if config.configFile != "" {
+		if err := applyConfigFile(config.configFile, explicit); err != nil {
+			fatalf(exitUsage, "❌ Failed to load config file: %v", err)
+		}
 	}
-	defer out.Close()
 
-	// Get the data
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
+	if err := applyEnv(explicit); err != nil {
+		fatalf(exitUsage, "❌ Invalid environment: %v", err)
 	}
-	defer resp.Body.Close()
 
-	// Check if we got a successful response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status code %d", resp.StatusCode)
+	if len(config.inputFiles) > 0 {
+		config.inputFile = config.inputFiles[0]
 	}
 
-	// Create a buffer for reading chunks
-	buf := make([]byte, 32*1024) // 32KB chunks
-	var totalBytes int64
-	lastPrint := time.Now()
+	// --diff takes the newer file as the only positional argument, so it has
+	// to come after every flag
+	if config.diffOld != "" {
+		if flag.NArg() != 1 {
+			fatalf(exitUsage, "❌ Error: --diff needs the new output file after it, e.g. --diff old.json new.json, with flags given before --diff")
+		}
+		config.diffNew = flag.Arg(0)
+	}
 
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			totalBytes += int64(n)
-			_, werr := out.Write(buf[:n])
-			if werr != nil {
-				return fmt.Errorf("error writing to file: %w", werr)
-			}
+	// Resolve the output path from the format when not set explicitly
+	if config.stdout {
+		config.output = pooltrim.StdoutPath
+	}
+	// --top writes its ranking as a flat list of pools. The default output
+	// file holds the token list that --list, --query and later runs read, so
+	// a flat list has to go elsewhere
+	if config.top > 0 && config.format == "json" {
+		config.flatOutput = true
+	}
+	if config.top > 0 && config.flatOutput && config.output == "" {
+		fatalf(exitUsage, "❌ Error: --top writes its ranking as a flat pool list and needs an explicit --output file or --stdout, separate from the %s token list", outputFile)
+	}
+	if config.flatOutput && config.output == "" {
+		fatalf(exitUsage, "❌ Error: --flat-output writes a flat pool list and needs an explicit --output file or --stdout, separate from the %s token list", outputFile)
+	}
+	if config.output == "" {
+		config.output = outputFile
+		switch config.format {
+		case "csv":
+			config.output = csvOutputFile
+		case "ndjson":
+			config.output = ndjsonOutputFile
+		}
+	}
 
-			// Update progress every 500ms
-			if time.Since(lastPrint) >= 500*time.Millisecond {
-				fmt.Printf("\rDownloading... %.1f MB    ", float64(totalBytes)/(1024*1024))
-				lastPrint = time.Now()
-			}
+	return config
+}
+
+// applyConfigFile sets every flag named in a YAML config file that was not
+// given on the command line. Lists may be written as YAML sequences
+func applyConfigFile(path string, explicit map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("invalid YAML in %s: %w", path, err)
+	}
+
+	for name, value := range values {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q in %s", name, path)
 		}
-		if err == io.EOF {
-			break
+		if explicit[name] {
+			continue
 		}
-		if err != nil {
-			return fmt.Errorf("error reading from response: %w", err)
+
+		text := fmt.Sprint(value)
+		if items, ok := value.([]any); ok {
+			parts := make([]string, len(items))
+			for i, item := range items {
+				parts[i] = fmt.Sprint(item)
+			}
+			text = strings.Join(parts, ",")
+		}
+		if err := flag.Set(name, text); err != nil {
+			return fmt.Errorf("invalid value for %s in %s: %w", name, path, err)
 		}
 	}
-	fmt.Printf("\rDownloaded %.1f MB         \n", float64(totalBytes)/(1024*1024))
+	return nil
+}
+
+// envFlags maps environment variables to the flags they set
+var envFlags = map[string]string{
+	"RAYDIUM_RPC_URL":    "rpc-url",
+	"RAYDIUM_POOL_URL":   "pool-url",
+	"RAYDIUM_TOKENS_URL": "tokens-url",
+	"RAYDIUM_OUTPUT":     "output",
+}
 
+// applyEnv applies environment variable overrides for flags that were not
+// given on the command line. They take precedence over the config file
+func applyEnv(explicit map[string]bool) error {
+	for env, name := range envFlags {
+		value, ok := os.LookupEnv(env)
+		if !ok || explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", env, err)
+		}
+	}
 	return nil
 }
 
-// validateJSON checks if the downloaded file is a valid and complete JSON
-func validateJSON(filePath string) error {
-	file, err := os.Open(filePath)
+// validateURL rejects URLs that are not absolute http(s) URLs
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("failed to open file for validation: %w", err)
+		return fmt.Errorf("failed to parse URL: %w", err)
 	}
-	defer file.Close()
-
-	// Create a decoder for validation
-	decoder := json.NewDecoder(file)
-
-	// Try to decode and validate structure
-	var response RaydiumResponse
-	if err := decoder.Decode(&response); err != nil {
-		return fmt.Errorf("invalid JSON structure: %w", err)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q in %q, expected http or https", u.Scheme, rawURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in %q", rawURL)
 	}
+	return nil
+}
 
-	// Basic validation of the response
-	if response.Name == "" {
-		return fmt.Errorf("invalid JSON: missing name field")
+// orderPools sorts each token's pools by --sort-by and keeps the first
+// --limit. Without an explicit order, --limit keeps the deepest pools when
+// reserves are known and the newest versions otherwise
+func orderPools(config *Config, pools map[string][]pooltrim.RaydiumPool) {
+	if config.limit > 0 && config.sortBy == "" {
+		config.sortBy, config.sortDesc = "version", true
+		if config.withReserves || config.minLiquidity > 0 || config.withPrice {
+			config.sortBy = "liquidity"
+		}
 	}
-	if response.Official == nil {
-		return fmt.Errorf("invalid JSON: missing official pools array")
+	if config.sortBy != "" {
+		if err := pooltrim.SortPools(pools, config.sortBy, config.sortDesc); err != nil {
+			fatalf(exitUsage, "❌ Failed to sort pools: %v", err)
+		}
 	}
-	if len(response.Official) == 0 {
-		return fmt.Errorf("invalid JSON: empty pools array")
+	if config.limit > 0 {
+		if dropped := pooltrim.LimitPools(pools, config.limit); dropped > 0 {
+			logf("✂️  Kept the top %d pools per token by %s, dropped %d\n", config.limit, config.sortBy, dropped)
+		}
 	}
+}
 
-	fmt.Printf("✅ JSON validation successful: found %d pools\n", len(response.Official))
-	return nil
+// loadCounterTokens loads the token list naming the counter tokens of
+// --any-quote pairs. It returns nil and no path when the list is
+// unavailable, leaving the counter tokens as mint addresses
+func loadCounterTokens(ctx context.Context, dl *pooltrim.Downloader, cache *pooltrim.FileCache, config Config) (*pooltrim.TokenMap, string) {
+	tokenFilePath, err := pooltrim.ResolveTokenFile(ctx, dl, cache, config.tokenFile, config.tokensURL)
+	var tokenMap *pooltrim.TokenMap
+	if err == nil {
+		tokenMap, err = pooltrim.LoadTokenMap(tokenFilePath, config.strictSchema)
+	}
+	var validation *pooltrim.ValidationError
+	if config.strictSchema && errors.As(err, &validation) {
+		fatalf(exitValidation, "❌ Failed to read token list: %v", err)
+	}
+	if err != nil {
+		warnf("⚠️  Counter tokens are left as mint addresses: %v\n", err)
+		return nil, ""
+	}
+	return tokenMap, tokenFilePath
 }
 
-// processPoolsFile processes the downloaded JSON file and filters pools
-func processPoolsFile(filePath string, baseMint string, ticker string) ([]RaydiumPool, error) {
-	file, err := os.Open(filePath)
+// filterSnapshots filters several pool files, such as daily snapshots, and
+// writes an entry per token and file, tagged with the file, so the pools of
+// a token can be compared across them. It reports whether a file had no
+// pools for one of the tokens
+func filterSnapshots(ctx context.Context, config *Config, writeOpts pooltrim.WriteOptions, filter *pooltrim.PoolFilter, tokens []*pooltrim.TokenInfo, quote *pooltrim.TokenInfo, tokenMap *pooltrim.TokenMap) bool {
+	for _, path := range config.inputFiles {
+		if !pooltrim.FileExists(path) {
+			fatalf(exitUsage, "❌ Provided file does not exist: %s", path)
+		}
+	}
+	logf("Filtering %d pool files, %d at a time\n", len(config.inputFiles), config.fileWorkers)
+
+	// Progress lines of concurrent scans would overwrite each other
+	scanFilter := *filter
+	scanFilter.ProgressInterval = 0
+	scans, err := pooltrim.ProcessPoolFiles(ctx, config.inputFiles, config.fileWorkers, tokens, quote, &scanFilter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	fmt.Println("\n🔍 Processing pools...")
-	fmt.Printf("Looking for %s/SOL pairs with:\n", strings.ToUpper(ticker))
-	fmt.Printf("  Base Token:  %s\n", baseMint)
-	fmt.Printf("  Quote Token: %s\n\n", defaultQuoteMint)
-
-	decoder := json.NewDecoder(file)
-
-	if _, err := decoder.Token(); err != nil {
-		return nil, fmt.Errorf("failed to read opening token: %w", err)
-	}
-
-	var matchingPools []RaydiumPool
-	var currentSection string
-	var officialCount, unofficialCount int
-
-	// Helper function to process a pool
-	processPool := func(pool RaydiumPool, isOfficial bool) {
-		if pool.BaseMint == baseMint || pool.QuoteMint == baseMint {
-			// Check if this is a token/SOL pair
-			if (pool.BaseMint == baseMint && pool.QuoteMint == defaultQuoteMint) ||
-				(pool.QuoteMint == baseMint && pool.BaseMint == defaultQuoteMint) {
-				fmt.Printf("\n📊 Pool Details (%s):\n", map[bool]string{true: "Official", false: "Unofficial"}[isOfficial])
-				fmt.Printf("  ID:              %s\n", pool.ID)
-				fmt.Printf("  Base Token:      %s\n", pool.BaseMint)
-				fmt.Printf("  Quote Token:     %s\n", pool.QuoteMint)
-				fmt.Printf("  LP Token:        %s\n", pool.LPMint)
-				fmt.Printf("  Program ID:      %s\n", pool.ProgramID)
-				fmt.Printf("  Market ID:       %s\n", pool.MarketID)
-				fmt.Printf("  Version:         %d\n", pool.Version)
-				fmt.Printf("  Market Version:  %d\n", pool.MarketVersion)
-				fmt.Printf("  Base Decimals:   %d\n", pool.BaseDecimals)
-				fmt.Printf("  Quote Decimals:  %d\n", pool.QuoteDecimals)
-				fmt.Printf("  LP Decimals:     %d\n", pool.LPDecimals)
-				fmt.Printf("  ✨ %s/SOL pair found!\n", strings.ToUpper(ticker))
-				matchingPools = append(matchingPools, pool)
-			}
+		fatalf(failureCode(err), "❌ Failed to process pools: %v", err)
+	}
+
+	logf("\n📄 Matches per file:\n")
+	var entries []pooltrim.TokenPoolInfo
+	empty := false
+	for _, scan := range scans {
+		orderPools(config, scan.Pools)
+		fileEntries := pooltrim.PoolEntries(tokens, quote, scan.Pools)
+		if config.anyQuote {
+			fileEntries = pooltrim.QuoteEntries(tokens, scan.Pools, tokenMap)
 		}
+		for _, token := range tokens {
+			logf("  %s: %d %s pools\n", scan.Path, len(scan.Pools[token.Mint]), token.Symbol)
+			empty = empty || len(scan.Pools[token.Mint]) == 0
+		}
+		for i := range fileEntries {
+			fileEntries[i].File = scan.Path
+		}
+		entries = append(entries, fileEntries...)
 	}
 
-	// Process the JSON structure
-	for decoder.More() {
-		token, err := decoder.Token()
+	if config.backup && !config.summaryOnly && !config.dryRun && config.output != pooltrim.StdoutPath && pooltrim.FileExists(config.output) {
+		backupPath, err := pooltrim.BackupFile(config.output)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read field name: %w", err)
+			fatalf(exitFailure, "❌ Failed to back up output file: %v", err)
 		}
+		logf("💾 Backed up %s to %s\n", config.output, backupPath)
+	}
 
-		if key, ok := token.(string); ok {
-			switch key {
-			case "name":
-				if _, err := decoder.Token(); err != nil {
-					return nil, fmt.Errorf("failed to skip name value: %w", err)
-				}
-			case "official", "unOfficial":
-				currentSection = key
+	switch {
+	case config.summaryOnly:
+		logf("\n📝 Summary only, nothing written\n")
+	case config.dryRun:
+		err = pooltrim.PreviewPoolEntries(config.output, entries, writeOpts)
+	default:
+		err = pooltrim.WritePoolEntries(config.output, entries, writeOpts)
+	}
+	var corrupt *pooltrim.CorruptOutputError
+	if errors.As(err, &corrupt) {
+		fatalf(exitValidation, "❌ Failed to write filtered pools: %v. Rerun with --recover to move it to %s.corrupt and start a fresh file, or --force to replace it", err, corrupt.Path)
+	}
+	if err != nil {
+		fatalf(outputFailureCode(err), "❌ Failed to write filtered pools: %v", err)
+	}
+	return empty
+}
 
-				t, err := decoder.Token()
-				if err != nil {
-					return nil, fmt.Errorf("failed to read array start: %w", err)
-				}
-				if delim, ok := t.(json.Delim); !ok || delim != '[' {
-					return nil, fmt.Errorf("expected array start, got %v", t)
-				}
+// filterFlags are the flags recorded as the filters of a run in the output
+// metadata
+var filterFlags = []string{
+	"pool-version", "min-version", "min-decimals", "max-decimals", "official-only", "unofficial-only", "max-unofficial",
+	"program-id", "market-program-id", "market-id", "market-version", "any-quote", "exact",
+	"min-liquidity-sol", "with-reserves", "with-price", "sort-by", "sort-desc", "top", "limit",
+}
 
-				for decoder.More() {
-					var pool RaydiumPool
-					if err := decoder.Decode(&pool); err != nil {
-						return nil, fmt.Errorf("failed to decode pool: %w", err)
-					}
-
-					if currentSection == "official" {
-						officialCount++
-						processPool(pool, true)
-					} else {
-						unofficialCount++
-						if unofficialCount%100000 == 0 {
-							fmt.Printf("\rProcessed %dk unofficial pools...", unofficialCount/1000)
-						}
-						processPool(pool, false)
-					}
-				}
+// filterFlagValues returns the values of the filter flags that were set on
+// the command line or in the config file, by flag name
+func filterFlagValues() map[string]string {
+	filters := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(filterFlags, f.Name) {
+			filters[f.Name] = f.Value.String()
+		}
+	})
+	return filters
+}
 
-				t, err = decoder.Token()
-				if err != nil {
-					return nil, fmt.Errorf("failed to read array end: %w", err)
-				}
-				if delim, ok := t.(json.Delim); !ok || delim != ']' {
-					return nil, fmt.Errorf("expected array end, got %v", t)
-				}
+// newHTTPClient returns a client with the given timeout that sends requests
+// through proxy, or through the proxy named by HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY when proxy is nil
+func newHTTPClient(timeout time.Duration, proxy *url.URL) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
 
-				if currentSection == "unOfficial" {
-					fmt.Printf("\rProcessed %dk unofficial pools\n", unofficialCount/1000)
-				}
-			}
+// marketTokens returns the base tokens of the pools found by a market ID
+// lookup, in mint order, and the quote token of the first pool. Symbols are
+// looked up in tokenMap, which may be nil
+func marketTokens(pools map[string][]pooltrim.RaydiumPool, tokenMap *pooltrim.TokenMap) ([]*pooltrim.TokenInfo, *pooltrim.TokenInfo) {
+	resolve := func(mint string) *pooltrim.TokenInfo {
+		if token, ok := tokenMap.Mint(mint); ok {
+			return &token
 		}
+		return pooltrim.QuoteTokenInfo(mint)
+	}
+
+	mints := make([]string, 0, len(pools))
+	for mint := range pools {
+		mints = append(mints, mint)
+	}
+	slices.Sort(mints)
+	if len(mints) == 0 {
+		return nil, nil
 	}
 
-	fmt.Printf("\n📈 Pool Summary:\n")
-	fmt.Printf("  Total Official Pools:   %d\n", officialCount)
-	fmt.Printf("  Total Unofficial Pools: %d\n", unofficialCount)
-	fmt.Printf("  Found %d %s/SOL pairs\n", len(matchingPools), strings.ToUpper(ticker))
-	return matchingPools, nil
+	tokens := make([]*pooltrim.TokenInfo, 0, len(mints))
+	total := 0
+	for _, mint := range mints {
+		token := resolve(mint)
+		tokens = append(tokens, token)
+		total += len(pools[mint])
+		logf("Market %s base token: %s (%s)\n", pools[mint][0].MarketID, token.Symbol, token.Mint)
+	}
+	quote := resolve(pools[mints[0]][0].QuoteMint)
+	if total > 1 {
+		warnf("⚠️  Found %d pools on the market, writing them all with quote %s\n", total, quote.Symbol)
+	}
+	return tokens, quote
 }
 
-// getTokenAddress fetches the token address from Raydium's API
-func getTokenAddress(symbol string, tokenFile string) ([]*TokenInfo, error) {
-	var jsonFilePath string
-	var matchingTokens []*TokenInfo
+// writeStats writes the scan statistics to path as JSON
+func writeStats(path string, stats *pooltrim.ScanStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal stats: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write stats file: %w", err)
+	}
+	return nil
+}
+
+// resolveMint completes a token given by its mint from the token list. It
+// reports false when the mint is not listed, leaving the token named after
+// its symbol with 9 decimals
+func resolveMint(tokenMap *pooltrim.TokenMap, token *pooltrim.TokenInfo) bool {
+	if found, ok := tokenMap.Mint(token.Mint); ok {
+		logf("Found %s in the token list: %s, %d decimals\n", token.Mint, found.Symbol, found.Decimals)
+		*token = found
+		return true
+	}
+	token.Name = fmt.Sprintf("%s (Direct Mint)", token.Symbol)
+	token.Decimals = 9
+	return false
+}
+
+// printRanking logs the pools kept by --top from deepest to shallowest
+func printRanking(ranked []pooltrim.RankedPool, tokens []*pooltrim.TokenInfo) {
+	symbols := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		symbols[token.Mint] = token.Symbol
+	}
 
-	if tokenFile != "" {
-		if !fileExists(tokenFile) {
-			return nil, fmt.Errorf("token file does not exist: %s", tokenFile)
+	if len(ranked) == 0 {
+		return
+	}
+	logf("\n🏆 Top %d %s pools by liquidity:\n", len(ranked), pooltrim.QuoteTokenInfo(ranked[0].Quote).Symbol)
+	w := tabwriter.NewWriter(pooltrim.LogOutput, 0, 0, 2, ' ', 0)
+	for i, r := range ranked {
+		liquidity := "unknown"
+		if r.Liquidity != nil {
+			liquidity = strconv.FormatFloat(*r.Liquidity, 'f', -1, 64)
 		}
-		jsonFilePath = tokenFile
-		fmt.Printf("Using provided token file: %s\n", jsonFilePath)
-	} else {
-		jsonFilePath = filepath.Join("tmp", fmt.Sprintf("raydium-tokens-%d.json", time.Now().UnixNano()))
-		if err := downloadFile(raydiumTokensURL, jsonFilePath); err != nil {
-			return nil, fmt.Errorf("failed to download token list: %w", err)
+		fmt.Fprintf(w, "  %d.\t%s/%s\t%s\t%s\n", i+1, symbols[r.Mint], pooltrim.QuoteTokenInfo(r.Quote).Symbol, r.Pool.ID, liquidity)
+	}
+	w.Flush()
+}
+
+// phaseTiming is the wall-clock duration of one phase of a run
+type phaseTiming struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// phaseTimer records how long each phase of a run takes for --bench
+type phaseTimer struct {
+	last   time.Time
+	phases []phaseTiming
+}
+
+// mark records the time since the previous mark as the named phase
+func (t *phaseTimer) mark(phase string) {
+	now := time.Now()
+	t.phases = append(t.phases, phaseTiming{Phase: phase, Seconds: now.Sub(t.last).Seconds()})
+	t.last = now
+}
+
+// print logs a table of the phases with their share of the total time
+func (t *phaseTimer) print() {
+	var total float64
+	for _, p := range t.phases {
+		total += p.Seconds
+	}
+
+	logf("\n⏱️  Phase timings:\n")
+	w := tabwriter.NewWriter(pooltrim.LogOutput, 0, 0, 2, ' ', 0)
+	for _, p := range t.phases {
+		share := 0.0
+		if total > 0 {
+			share = p.Seconds / total * 100
 		}
+		fmt.Fprintf(w, "  %s\t%.3fs\t%3.0f%%\n", p.Phase, p.Seconds, share)
 	}
+	fmt.Fprintf(w, "  total\t%.3fs\n", total)
+	w.Flush()
+}
 
-	file, err := os.Open(jsonFilePath)
+// writeJSON writes the phase timings to path as JSON
+func (t *phaseTimer) writeJSON(path string) error {
+	data, err := json.MarshalIndent(t.phases, "", "  ")
 	if err != nil {
-		return nil, fmt.Errorf("failed to open token file: %w", err)
+		return fmt.Errorf("failed to marshal phase timings: %w", err)
 	}
-	defer file.Close()
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write phase timings: %w", err)
+	}
+	return nil
+}
 
-	decoder := json.NewDecoder(file)
-	t, err := decoder.Token()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read opening token: %w", err)
+// writeMetrics atomically writes run metrics to path in the Prometheus text
+// format read by node_exporter's textfile collector. It only runs after a
+// successful run, so a stale last_success_timestamp signals failures
+func writeMetrics(path string, stats *pooltrim.ScanStats, matched int, duration time.Duration) error {
+	var b strings.Builder
+	metric := func(name, help, kind string, value float64) {
+		fmt.Fprintf(&b, "# HELP raydium_pool_trim_%s %s\n", name, help)
+		fmt.Fprintf(&b, "# TYPE raydium_pool_trim_%s %s\n", name, kind)
+		fmt.Fprintf(&b, "raydium_pool_trim_%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
 	}
-	if delim, ok := t.(json.Delim); !ok || delim != '{' {
-		return nil, fmt.Errorf("expected object start, got %v", t)
+	metric("download_bytes", "Bytes of the pool list read, downloaded or from --file.", "gauge", float64(stats.BytesRead))
+	metric("pools_scanned", "Pools scanned in the pool list.", "gauge", float64(stats.OfficialPools+stats.UnofficialPools))
+	metric("pools_matched", "Pools kept for the requested tokens.", "gauge", float64(matched))
+	metric("run_duration_seconds", "Duration of the last successful run.", "gauge", duration.Seconds())
+	metric("last_success_timestamp", "Unix time of the last successful run.", "gauge", float64(time.Now().Unix()))
+
+	if err := pooltrim.WriteFileAtomic(path, []byte(b.String())); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
 	}
+	return nil
+}
+
+// logf prints an informational message to the log output
+func logf(format string, args ...any) {
+	pooltrim.Logf(pooltrim.LevelInfo, format, args...)
+}
 
-	symbol = strings.ToUpper(strings.TrimPrefix(symbol, "$"))
-	tokenCount := 0
+// warnf prints a warning to the log output
+func warnf(format string, args ...any) {
+	pooltrim.Logf(pooltrim.LevelWarn, format, args...)
+}
+
+// promptf prints a message the user must see to continue, regardless of the
+// log level
+func promptf(format string, args ...any) {
+	fmt.Fprintf(pooltrim.LogOutput, format, args...)
+}
 
-	for decoder.More() {
-		key, err := decoder.Token()
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseIntList parses a comma-separated list of integers
+func parseIntList(value string) ([]int, error) {
+	var ints []int
+	for _, item := range splitList(value) {
+		n, err := strconv.Atoi(item)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read field name: %w", err)
+			return nil, fmt.Errorf("invalid number %q", item)
 		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
 
-		if keyStr, ok := key.(string); ok {
-			switch keyStr {
-			case "official", "unOfficial":
-				t, err := decoder.Token()
-				if err != nil {
-					return nil, fmt.Errorf("failed to read array start: %w", err)
-				}
-				if delim, ok := t.(json.Delim); !ok || delim != '[' {
-					return nil, fmt.Errorf("expected array start for %s, got %v", keyStr, t)
-				}
+// findTokens looks up the tokens for a ticker symbol, printing the closest
+// symbols when none match
+func findTokens(symbol string, tokenMap *pooltrim.TokenMap, exact bool) ([]*pooltrim.TokenInfo, error) {
+	lookup := tokenMap.Lookup
+	if exact {
+		lookup = tokenMap.LookupExact
+	}
 
-				for decoder.More() {
-					tokenCount++
-					if tokenCount%100 == 0 {
-						fmt.Printf("\rProcessed %d tokens...", tokenCount)
-					}
-
-					var token TokenInfo
-					if err := decoder.Decode(&token); err != nil {
-						return nil, fmt.Errorf("failed to decode token: %w", err)
-					}
-
-					if token.Symbol == symbol {
-						fmt.Printf("\n✅ Found %s token (%s):\n", symbol, keyStr)
-						fmt.Printf("  Name: %s\n", token.Name)
-						fmt.Printf("  Mint: %s\n", token.Mint)
-						fmt.Printf("  Decimals: %d\n", token.Decimals)
-						matchingTokens = append(matchingTokens, &token)
-					}
-				}
+	tokens, err := lookup(symbol)
+	var notFound *pooltrim.TokenNotFoundError
+	if errors.As(err, &notFound) && len(notFound.Suggestions) > 0 {
+		promptf("\n🤔 No token with symbol %s. Did you mean:\n", notFound.Symbol)
+		for _, token := range notFound.Suggestions {
+			promptf("  %s - %s (Mint: %s)\n", token.Symbol, token.Name, token.Mint)
+		}
+	}
+	return tokens, err
+}
 
-				t, err = decoder.Token()
-				if err != nil {
-					return nil, fmt.Errorf("failed to read array end: %w", err)
-				}
-				if delim, ok := t.(json.Delim); !ok || delim != ']' {
-					return nil, fmt.Errorf("expected array end for %s, got %v", keyStr, t)
+// stdinReader reads answers to interactive prompts
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// listFile returns the output file read by --list and --query, which is the
+// JSON output even when writing CSV or stdout
+func (c Config) listFile() string {
+	if c.format != "json" || c.output == pooltrim.StdoutPath {
+		return outputFile
+	}
+	return c.output
+}
+
+// printTokenList prints a table of the entries in an output file to stdout
+func printTokenList(tokenList pooltrim.TokenPoolInfoList) {
+	// Entries filtered from several snapshots also show their file
+	withFile := slices.ContainsFunc(tokenList.Tokens, func(entry pooltrim.TokenPoolInfo) bool { return entry.File != "" })
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if withFile {
+		fmt.Fprintln(writer, "SYMBOL\tQUOTE\tMINT\tFILE\tPOOLS")
+	} else {
+		fmt.Fprintln(writer, "SYMBOL\tQUOTE\tMINT\tPOOLS")
+	}
+	for _, entry := range tokenList.Tokens {
+		quote := "SOL"
+		if entry.Quote != nil {
+			quote = entry.Quote.Symbol
+		}
+		if withFile {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%d\n", entry.Token.Symbol, quote, entry.Token.Mint, entry.File, len(entry.Pools))
+			continue
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\n", entry.Token.Symbol, quote, entry.Token.Mint, len(entry.Pools))
+	}
+	writer.Flush()
+}
+
+// printDiff prints the pools added, removed and changed per token to stdout
+func printDiff(diffs []pooltrim.EntryDiff) {
+	if len(diffs) == 0 {
+		fmt.Println("No pool changes")
+		return
+	}
+	for _, diff := range diffs {
+		fmt.Printf("%s/%s (%s)", diff.Symbol, diff.Quote, diff.Mint)
+		if diff.File != "" {
+			fmt.Printf(" in %s", diff.File)
+		}
+		fmt.Printf(": %d added, %d removed, %d changed\n", len(diff.Added), len(diff.Removed), len(diff.Changed))
+		for _, id := range diff.Added {
+			fmt.Printf("  + %s\n", id)
+		}
+		for _, id := range diff.Removed {
+			fmt.Printf("  - %s\n", id)
+		}
+		for _, change := range diff.Changed {
+			fmt.Printf("  ~ %s (%s)\n", change.ID, strings.Join(change.Fields, ", "))
+		}
+	}
+}
+
+// selectToken returns the single matching token when the query, such as
+// "with symbol BONK", matches multiple mints. In interactive mode the user
+// picks one on stdin, otherwise the choices are printed and the program exits
+func selectToken(tokens []*pooltrim.TokenInfo, query string, usage string, interactive bool) *pooltrim.TokenInfo {
+	if len(tokens) > 1 {
+		promptf("\n🔍 Found multiple tokens %s. Please choose one:\n", query)
+		for i, token := range tokens {
+			promptf("%d) %s - %s (Mint: %s)\n", i+1, token.Symbol, token.Name, token.Mint)
+		}
+		if interactive && isTerminal(os.Stdin) {
+			for {
+				promptf("Enter a number (1-%d): ", len(tokens))
+				line, err := stdinReader.ReadString('\n')
+				if choice, convErr := strconv.Atoi(strings.TrimSpace(line)); convErr == nil && choice >= 1 && choice <= len(tokens) {
+					return tokens[choice-1]
 				}
-			default:
-				_, err := decoder.Token()
 				if err != nil {
-					return nil, fmt.Errorf("failed to skip value: %w", err)
+					fatalf(exitFailure, "❌ Failed to read selection: %v", err)
 				}
+				promptf("⚠️  Invalid choice %q\n", strings.TrimSpace(line))
 			}
 		}
+		promptf("\nRe-run the command with %s to use a specific token\n", usage)
+		os.Exit(0)
 	}
 
-	t, err = decoder.Token()
+	return tokens[0]
+}
+
+func main() {
+	start := time.Now()
+	config := parseFlags()
+	pooltrim.LogOutput = os.Stdout
+	if config.output == pooltrim.StdoutPath || config.list || config.query != "" || config.diffOld != "" {
+		pooltrim.LogOutput = os.Stderr
+	}
+	level, err := pooltrim.ParseLevel(config.logLevel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read closing token: %w", err)
+		fatalf(exitUsage, "❌ Error: invalid --log-level: %v", err)
+	}
+	if config.quiet && config.verbose {
+		fatalf(exitUsage, "❌ Error: --quiet and --verbose are mutually exclusive")
+	}
+	if config.verbose {
+		level = pooltrim.LevelDebug
 	}
-	if delim, ok := t.(json.Delim); !ok || delim != '}' {
-		return nil, fmt.Errorf("expected object end, got %v", t)
+	if config.quiet {
+		level = pooltrim.LevelError
+	}
+	pooltrim.LogLevel = level
+	if config.jsonLogs {
+		pooltrim.LogOutput = os.Stderr
+		pooltrim.EnableJSONLogs(os.Stderr)
 	}
 
-	fmt.Printf("\nProcessed %d tokens total\n", tokenCount)
-	if len(matchingTokens) == 0 {
-		return nil, fmt.Errorf("token %s not found", symbol)
+	// Redrawn progress lines only make sense on a terminal
+	if config.progress == "" {
+		config.progress = "plain"
+		if out, ok := pooltrim.LogOutput.(*os.File); ok && !config.jsonLogs && isTerminal(out) {
+			config.progress = "bar"
+		}
+	}
+	progress, err := pooltrim.ParseProgressStyle(config.progress)
+	if err != nil {
+		fatalf(exitUsage, "❌ Error: invalid --progress: %v", err)
+	}
+	pooltrim.Progress = progress
+	writeOpts := pooltrim.WriteOptions{
+		Compact:        config.compact,
+		AppendOnly:     config.appendOnly,
+		Overwrite:      config.force,
+		RecoverCorrupt: config.recover,
+	}
+	if config.fields != "" {
+		fields, err := pooltrim.ParsePoolFields(config.fields)
+		if err != nil {
+			fatalf(exitUsage, "❌ Error: invalid --fields: %v", err)
+		}
+		writeOpts.Fields = fields
+	}
+
+	logf("🌊 Raydium Pool Fetcher\n")
+	logf("------------------------\n")
+
+	// Cancel in-flight downloads, parsing and RPC calls on Ctrl-C, SIGTERM or
+	// once --deadline passes. Cancelled downloads remove their partial temp
+	// files as they return
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		warnf("\n🛑 Received %v, stopping and removing partial downloads (repeat to exit immediately)\n", sig)
+		// Restore the default handling so a second signal kills the process
+		signal.Stop(signals)
+		stop()
+	}()
+	if config.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.deadline)
+		defer cancel()
+	}
+
+	// An explicit proxy overrides the proxy environment variables
+	var proxyURL *url.URL
+	if config.proxy != "" {
+		var err error
+		if proxyURL, err = url.Parse(config.proxy); err != nil || proxyURL.Host == "" {
+			fatalf(exitUsage, "❌ Error: invalid --proxy %q, expected a URL such as http://proxy:3128", config.proxy)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			fatalf(exitUsage, "❌ Error: unsupported --proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+		}
 	}
-	return matchingTokens, nil
-}
 
-// writeFilteredPools writes or appends the filtered pools to the output file
-func writeFilteredPools(tokenInfo *TokenInfo, pools []RaydiumPool) error {
-	var tokenList TokenPoolInfoList
+	dl := &pooltrim.Downloader{
+		Client:     newHTTPClient(config.httpTimeout, proxyURL),
+		Dir:        config.tmpDir,
+		MaxRetries: config.maxRetries,
+		Offline:    config.offline,
+		UserAgent:  config.userAgent,
 
-	// Try to read existing file
-	if fileExists(outputFile) {
-		existingFile, err := os.ReadFile(outputFile)
+		SkipSpaceCheck: config.skipSpaceCheck,
+	}
+
+	cache, err := pooltrim.NewFileCache(config.cacheTTL, config.refresh)
+	if err != nil {
+		fatalf(exitUsage, "❌ Failed to set up download cache: %v", err)
+	}
+	cache.Revalidate = config.ifNoneMatch
+
+	if config.clean {
+		removed, reclaimed, err := pooltrim.CleanDownloads(dl.Dir, cache.Dir)
 		if err != nil {
-			return fmt.Errorf("failed to read existing output file: %w", err)
+			fatalf(exitFailure, "❌ Clean failed: %v", err)
 		}
+		logf("✅ Removed %d files, reclaimed %.1f MB\n", removed, float64(reclaimed)/(1024*1024))
+		return
+	}
 
-		if err := json.Unmarshal(existingFile, &tokenList); err != nil {
-			// If the file exists but isn't in the new format, try to read it as a single TokenPoolInfo
-			var oldFormat TokenPoolInfo
-			if err := json.Unmarshal(existingFile, &oldFormat); err != nil {
-				return fmt.Errorf("failed to parse existing output file: %w", err)
+	if config.diffOld != "" {
+		if config.diffFormat != "text" && config.diffFormat != "json" {
+			fatalf(exitUsage, "❌ Error: unsupported --diff-format %q, expected text or json", config.diffFormat)
+		}
+		diffs, err := pooltrim.DiffOutputFiles(config.diffOld, config.diffNew)
+		if err != nil {
+			fatalf(outputFailureCode(err), "❌ Failed to compare %s with %s: %v", config.diffOld, config.diffNew, err)
+		}
+		if config.diffFormat == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if diffs == nil {
+				diffs = []pooltrim.EntryDiff{}
 			}
-			// Convert old format to new format
-			tokenList.Tokens = []TokenPoolInfo{oldFormat}
-		}
-
-		// Check if token already exists and update it
-		updated := false
-		for i, existing := range tokenList.Tokens {
-			if existing.Token.Symbol == tokenInfo.Symbol {
-				fmt.Printf("🔄 Updating existing entry for %s in the output file...\n", tokenInfo.Symbol)
-				tokenList.Tokens[i] = TokenPoolInfo{
-					Token: *tokenInfo,
-					Pools: pools,
-				}
-				updated = true
-				break
+			if err := encoder.Encode(diffs); err != nil {
+				fatalf(exitFailure, "❌ Failed to write diff: %v", err)
 			}
+			return
 		}
+		printDiff(diffs)
+		return
+	}
 
-		// If token wasn't found, append it
-		if !updated {
-			tokenList.Tokens = append(tokenList.Tokens, TokenPoolInfo{
-				Token: *tokenInfo,
-				Pools: pools,
-			})
+	if config.list {
+		tokenList, err := pooltrim.ReadOutputFile(config.listFile())
+		if err != nil {
+			fatalf(outputFailureCode(err), "❌ Failed to list output file: %v", err)
 		}
-	} else {
-		// Create new file with the token info
-		tokenList.Tokens = []TokenPoolInfo{{
-			Token: *tokenInfo,
-			Pools: pools,
-		}}
+		printTokenList(tokenList)
+		return
 	}
 
-	// Write back to file
-	file, err := os.Create(outputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	if config.query != "" {
+		entries, err := pooltrim.QueryToken(config.listFile(), config.query)
+		if err != nil {
+			fatalf(outputFailureCode(err), "❌ Query failed: %v", err)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(pooltrim.TokenPoolInfoList{Tokens: entries}); err != nil {
+			fatalf(exitFailure, "❌ Failed to write query result: %v", err)
+		}
+		return
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
+	if config.mergeFrom != "" {
+		if config.format != "json" || config.output == pooltrim.StdoutPath {
+			fatalf(exitUsage, "❌ Error: --merge-from needs a JSON output file")
+		}
+		if config.backup && pooltrim.FileExists(config.output) {
+			backupPath, err := pooltrim.BackupFile(config.output)
+			if err != nil {
+				fatalf(exitFailure, "❌ Failed to back up output file: %v", err)
+			}
+			logf("💾 Backed up %s to %s\n", config.output, backupPath)
+		}
 
-	if err := encoder.Encode(tokenList); err != nil {
-		return fmt.Errorf("failed to write output file: %w", err)
+		result, err := pooltrim.MergeOutputFile(config.output, config.mergeFrom, writeOpts)
+		if err != nil {
+			fatalf(outputFailureCode(err), "❌ Failed to merge %s: %v", config.mergeFrom, err)
+		}
+		for _, conflict := range result.Conflicts {
+			warnf("⚠️  Skipped %s/%s from %s: mint %s conflicts with stored mint %s\n",
+				conflict.Symbol, conflict.Quote, config.mergeFrom, conflict.Mint, conflict.ExistingMint)
+		}
+		logf("✅ Merged %s into %s: %d entries added, %d updated, %d conflicts\n",
+			config.mergeFrom, config.output, result.Added, result.Updated, len(result.Conflicts))
+		return
 	}
 
-	fmt.Printf("✅ Successfully wrote/updated token info and %d pools to %s\n", len(pools), outputFile)
-	fmt.Printf("📊 File now contains information for %d tokens\n", len(tokenList.Tokens))
-	return nil
-}
-
-func main() {
-	fmt.Println("🌊 Raydium Pool Fetcher")
-	fmt.Println("------------------------")
+	if config.remove != "" {
+		if config.format != "json" || config.output == pooltrim.StdoutPath {
+			fatalf(exitUsage, "❌ Error: --remove needs a JSON output file")
+		}
+		if !pooltrim.FileExists(config.output) {
+			fatalf(exitUsage, "❌ Output file does not exist: %s", config.output)
+		}
+		if config.backup {
+			backupPath, err := pooltrim.BackupFile(config.output)
+			if err != nil {
+				fatalf(exitFailure, "❌ Failed to back up output file: %v", err)
+			}
+			logf("💾 Backed up %s to %s\n", config.output, backupPath)
+		}
 
-	config := parseFlags()
+		removed, err := pooltrim.RemoveToken(config.output, config.remove, writeOpts)
+		if err != nil {
+			fatalf(outputFailureCode(err), "❌ Failed to remove %s: %v", config.remove, err)
+		}
+		if removed == 0 {
+			logf("ℹ️  No entry for %s in %s, nothing removed\n", config.remove, config.output)
+		} else {
+			logf("✅ Removed %d entries for %s from %s\n", removed, config.remove, config.output)
+		}
+		return
+	}
 
 	// Validate flags
-	if config.mint != "" && config.ticker == "" {
-		log.Fatalf("❌ Error: --ticker is required when using --mint\nUsage: --mint=<mint_address> --ticker=<token_symbol>")
+	tickers := splitList(config.ticker)
+	if config.mint != "" && len(tickers) != 1 {
+		fatalf(exitUsage, "❌ Error: a single --ticker is required when using --mint\nUsage: --mint=<mint_address> --ticker=<token_symbol>")
+	}
+
+	// Catch mistyped addresses before scanning the whole pool list for nothing
+	quoteMints := splitList(config.quoteMint)
+	for _, mint := range quoteMints {
+		if err := pooltrim.ValidateMint(mint); err != nil {
+			fatalf(exitUsage, "❌ Error: --quote-mint: %v", err)
+		}
+	}
+	for flagName, mint := range map[string]string{"--mint": config.mint, "--lookup-mint": config.lookupMint, "--market-id": config.marketID} {
+		if mint == "" {
+			continue
+		}
+		if err := pooltrim.ValidateMint(mint); err != nil {
+			fatalf(exitUsage, "❌ Error: %s: %v", flagName, err)
+		}
+	}
+	for flagName, rawURL := range map[string]string{"--pool-url": config.poolURL, "--tokens-url": config.tokensURL} {
+		if err := validateURL(rawURL); err != nil {
+			fatalf(exitUsage, "❌ Error: %s: %v", flagName, err)
+		}
+	}
+	if config.quoteMint != "" && config.quoteTicker != "" {
+		fatalf(exitUsage, "❌ Error: --quote-mint and --quote-ticker are mutually exclusive")
+	}
+	if config.anyQuote && (config.quoteMint != "" || config.quoteTicker != "") {
+		fatalf(exitUsage, "❌ Error: --any-quote cannot be combined with --quote-mint or --quote-ticker")
+	}
+
+	// Several quote mints are matched like --any-quote, restricted to them,
+	// so each pool records its actual quote
+	multiQuote := len(quoteMints) > 1
+	// Reserves of different quote tokens are not comparable, so --top ranks
+	// the pools of a single quote token
+	if config.top > 0 && (config.anyQuote || multiQuote) {
+		fatalf(exitUsage, "❌ Error: --top ranks pools by quote reserve across all tokens and needs a single quote token, it cannot be combined with --any-quote or several quote mints")
+	}
+	config.anyQuote = config.anyQuote || multiQuote
+	if config.offline && config.inputFile == "" {
+		fatalf(exitUsage, "❌ Error: --file is required in offline mode")
+	}
+	if config.keepUnknown && config.strictSchema {
+		fatalf(exitUsage, "❌ Error: --keep-unknown-fields and --strict-schema are mutually exclusive")
+	}
+	if config.flatOutput && config.format != "json" {
+		fatalf(exitUsage, "❌ Error: --flat-output needs --format=json")
+	}
+	if config.top > 0 && config.flatOutput && config.appendOnly {
+		fatalf(exitUsage, "❌ Error: --top replaces the output file and cannot be combined with --append-only")
+	}
+	if config.flatOutput && config.appendOnly {
+		fatalf(exitUsage, "❌ Error: --flat-output replaces the output file and cannot be combined with --append-only")
+	}
+	if config.flatSymbol && !config.flatOutput {
+		fatalf(exitUsage, "❌ Error: --flat-symbol requires --flat-output")
+	}
+	if config.force && config.appendOnly {
+		fatalf(exitUsage, "❌ Error: --force and --append-only are mutually exclusive")
+	}
+	if config.official && config.unofficial {
+		fatalf(exitUsage, "❌ Error: --official-only and --unofficial-only are mutually exclusive")
+	}
+	if config.format != "json" && config.format != "csv" && config.format != "ndjson" {
+		fatalf(exitUsage, "❌ Error: unsupported --format %q, expected json, csv or ndjson", config.format)
+	}
+	if config.decimals >= 0 && config.mint == "" {
+		fatalf(exitUsage, "❌ Error: --decimals requires --mint")
+	}
+	if config.decimals > 255 {
+		fatalf(exitUsage, "❌ Error: --decimals must be between 0 and 255")
+	}
+	if config.rpcConcurrency < 1 {
+		fatalf(exitUsage, "❌ Error: --rpc-concurrency must be at least 1")
+	}
+	if config.maxUnofficial < 0 {
+		fatalf(exitUsage, "❌ Error: --max-unofficial must not be negative")
+	}
+	if config.top < 0 {
+		fatalf(exitUsage, "❌ Error: --top must not be negative")
+	}
+	// Ranking by liquidity needs the reserves
+	if config.top > 0 {
+		config.withReserves = true
+	}
+	if config.limit < 0 {
+		fatalf(exitUsage, "❌ Error: --limit must not be negative")
+	}
+	if config.sortBy != "" && !slices.Contains(pooltrim.SortFields, config.sortBy) {
+		fatalf(exitUsage, "❌ Error: unsupported --sort-by %q, expected one of %s", config.sortBy, strings.Join(pooltrim.SortFields, ", "))
+	}
+	if len(config.inputFiles) > 1 {
+		// Several snapshots only go through the scan and a JSON write
+		switch {
+		case slices.Contains(config.inputFiles, pooltrim.StdinPath):
+			fatalf(exitUsage, "❌ Error: --file - cannot be combined with other files")
+		case config.fileWorkers < 1:
+			fatalf(exitUsage, "❌ Error: --file-workers must be at least 1")
+		case config.count:
+			fatalf(exitUsage, "❌ Error: --count takes a single --file")
+		case config.withReserves || config.minLiquidity > 0 || config.withPrice:
+			fatalf(exitUsage, "❌ Error: --with-reserves, --min-liquidity, --with-price and --top take a single --file")
+		case config.format != "json" || config.splitOutput != "" || config.flatOutput:
+			fatalf(exitUsage, "❌ Error: several --file inputs are written as a single JSON token list")
+		case config.strictValidate:
+			fatalf(exitUsage, "❌ Error: --strict-validate takes a single --file")
+		case config.statsJSON != "" || config.metricsFile != "":
+			fatalf(exitUsage, "❌ Error: --stats-json and --metrics-file describe a single scan and take a single --file")
+		}
 	}
 
-	var selectedToken *TokenInfo
+	filter := &pooltrim.PoolFilter{
+		Versions:    make(map[int]bool),
+		MinVersion:  config.minVersion,
+		MinDecimals: config.minDecimals,
+		MaxDecimals: config.maxDecimals,
+		Skip: map[string]bool{
+			pooltrim.SectionOfficial:   config.unofficial,
+			pooltrim.SectionUnofficial: config.official,
+		},
+		ProgramIDs:       make(map[string]bool),
+		MarketProgramIDs: make(map[string]bool),
+		MarketVersions:   make(map[int]bool),
+		MarketID:         config.marketID,
+		AnyQuote:         config.anyQuote,
+		QuoteMints:       make(map[string]bool),
+		Workers:          config.workers,
+		MaxUnofficial:    config.maxUnofficial,
+		ProgressInterval: config.progressInterval,
+
+		KeepUnknownFields: config.keepUnknown,
+		SkipBadPools:      config.skipBadPools,
+		StrictSchema:      config.strictSchema,
+	}
+	versions, err := parseIntList(config.versions)
+	if err != nil {
+		fatalf(exitUsage, "❌ Error: invalid --pool-version: %v", err)
+	}
+	for _, version := range versions {
+		filter.Versions[version] = true
+	}
+	if multiQuote {
+		for _, mint := range quoteMints {
+			filter.QuoteMints[mint] = true
+		}
+	}
+	for _, programID := range config.programIDs {
+		filter.ProgramIDs[programID] = true
+	}
+	for _, programID := range config.marketProgramIDs {
+		filter.MarketProgramIDs[programID] = true
+	}
+	marketVersions, err := parseIntList(config.marketVersions)
+	if err != nil {
+		fatalf(exitUsage, "❌ Error: invalid --market-version: %v", err)
+	}
+	for _, version := range marketVersions {
+		filter.MarketVersions[version] = true
+	}
 
-	// If mint is provided, create a token info
+	// Pools the scan skips are only checked for their JSON syntax up front;
+	// --strict-validate still decodes every pool
+	validatePools := pooltrim.ValidateJSON
+	if config.skipBadPools {
+		validatePools = pooltrim.ValidateJSONSyntax
+	}
+
+	// Counting needs neither tokens nor an output file
+	if config.count {
+		filter.CountOnly = true
+		var stats *pooltrim.ScanStats
+		if config.inputFile != "" {
+			if config.inputFile != pooltrim.StdinPath && !pooltrim.FileExists(config.inputFile) {
+				fatalf(exitUsage, "❌ Provided file does not exist: %s", config.inputFile)
+			}
+			_, stats, err = pooltrim.ProcessPoolsFile(ctx, config.inputFile, nil, nil, filter)
+		} else {
+			_, err = cache.Stream(ctx, dl, config.poolURL, pooltrim.PoolsCacheFile, config.sha256, validatePools, func(reader io.Reader) error {
+				var err error
+				_, stats, err = pooltrim.ProcessPools(ctx, reader, nil, nil, filter)
+				return err
+			})
+		}
+		if err != nil {
+			fatalf(failureCode(err), "❌ Failed to count pools: %v", err)
+		}
+		if config.statsJSON != "" {
+			if err := writeStats(config.statsJSON, stats); err != nil {
+				fatalf(exitFailure, "❌ Failed to write stats: %v", err)
+			}
+		}
+		logf("✅ %d official + %d unofficial = %d pools\n", stats.OfficialPools, stats.UnofficialPools, stats.OfficialPools+stats.UnofficialPools)
+		return
+	}
+
+	var selectedTokens []*pooltrim.TokenInfo
+
+	// If mint is provided, create a token info. Without --decimals its
+	// metadata is looked up in the token list below
+	var directMint *pooltrim.TokenInfo
 	if config.mint != "" {
-		selectedToken = &TokenInfo{
-			Symbol:   config.ticker,
-			Name:     fmt.Sprintf("%s (Direct Mint)", config.ticker),
+		directMint = &pooltrim.TokenInfo{
+			Symbol:   tickers[0],
+			Name:     fmt.Sprintf("%s (Direct Mint)", tickers[0]),
 			Mint:     config.mint,
-			Decimals: 9, // Default to 9 decimals
+			Decimals: config.decimals,
 		}
-		fmt.Printf("Using provided mint address directly: %s\n", config.mint)
-	} else {
-		// Get token address from Raydium API using provided ticker
-		tokens, err := getTokenAddress(config.ticker, config.tokenFile)
+		selectedTokens = append(selectedTokens, directMint)
+		logf("Using provided mint address directly: %s\n", config.mint)
+		tickers = nil
+	}
+
+	var watchMints []*pooltrim.TokenInfo
+	if config.watchlist != "" {
+		var watchTickers []string
+		var err error
+		watchTickers, watchMints, err = pooltrim.ReadWatchlist(config.watchlist)
 		if err != nil {
-			log.Fatalf("❌ Failed to get %s token address: %v", config.ticker, err)
+			fatalf(exitUsage, "❌ Failed to load watchlist: %v", err)
 		}
-
-		if len(tokens) > 1 {
-			fmt.Printf("\n🔍 Found multiple tokens with symbol %s. Please choose one:\n", config.ticker)
-			for i, token := range tokens {
-				fmt.Printf("%d) %s (Mint: %s)\n", i+1, token.Name, token.Mint)
+		for _, token := range watchMints {
+			if err := pooltrim.ValidateMint(token.Mint); err != nil {
+				fatalf(exitUsage, "❌ Error: watchlist %s: %v", config.watchlist, err)
 			}
-			fmt.Printf("\nRe-run the command with --mint=<mint_address> --ticker=%s to use a specific token\n", config.ticker)
-			os.Exit(0)
 		}
+		logf("Loaded %d tickers and %d mints from watchlist %s\n", len(watchTickers), len(watchMints), config.watchlist)
+		tickers = append(tickers, watchTickers...)
+		selectedTokens = append(selectedTokens, watchMints...)
+	}
 
-		selectedToken = tokens[0]
+	// A market ID on its own looks up the pools on that market whatever their mints
+	marketOnly := config.marketID != "" && len(tickers) == 0 && len(selectedTokens) == 0 && config.lookupMint == "" && config.name == ""
+	if len(tickers) == 0 && len(selectedTokens) == 0 && config.lookupMint == "" && config.name == "" && !marketOnly {
+		fatalf(exitUsage, "❌ Error: --ticker, --name, --lookup-mint, --watchlist or --market-id is required\nUsage: --ticker=<token_symbol>[,<token_symbol>...]")
+	}
+	if marketOnly && len(config.inputFiles) > 1 {
+		fatalf(exitUsage, "❌ Error: --market-id on its own takes a single --file")
 	}
 
-	// Update config with token address
-	config.mint = selectedToken.Mint
+	phases := &phaseTimer{last: time.Now()}
+
+	// The token list is decoded once and shared by every lookup
+	var tokenFilePath string
+	var tokenMap *pooltrim.TokenMap
+	needTokens := len(tickers) > 0 || config.quoteTicker != "" || config.lookupMint != "" || config.name != ""
+	lookupDirect := ((directMint != nil && config.decimals < 0) || len(watchMints) > 0) && !(config.offline && config.tokenFile == "")
+	if needTokens || lookupDirect {
+		var err error
+		tokenFilePath, err = pooltrim.ResolveTokenFile(ctx, dl, cache, config.tokenFile, config.tokensURL)
+		if err == nil {
+			tokenMap, err = pooltrim.LoadTokenMap(tokenFilePath, config.strictSchema)
+		}
+		// A token list failing --strict-schema fails even a direct mint lookup
+		var validation *pooltrim.ValidationError
+		if err != nil && (needTokens || (config.strictSchema && errors.As(err, &validation))) {
+			fatalf(failureCode(err), "❌ Failed to get token list: %v", err)
+		}
+		if err != nil {
+			warnf("⚠️  Failed to get token list to look up the given mints: %v\n", err)
+			tokenFilePath = ""
+		}
+	}
 
-	fmt.Printf("Base Token (%s): %s\n", config.ticker, config.mint)
-	fmt.Printf("Quote Token (SOL): %s\n\n", defaultQuoteMint)
+	if directMint != nil && config.decimals < 0 {
+		if !resolveMint(tokenMap, directMint) {
+			warnf("⚠️  %s is not in the token list, assuming 9 decimals. Pass --decimals if the token uses another precision\n", config.mint)
+		}
+	}
+	for _, token := range watchMints {
+		if !resolveMint(tokenMap, token) {
+			warnf("⚠️  %s is not in the token list, assuming 9 decimals\n", token.Mint)
+		}
+	}
+
+	// Reverse lookup: resolve the mint to its ticker
+	if config.lookupMint != "" {
+		token, err := tokenMap.LookupMint(config.lookupMint)
+		if err != nil {
+			fatalf(exitNotFound, "❌ Failed to look up mint %s: %v", config.lookupMint, err)
+		}
+		selectedTokens = append(selectedTokens, token)
+	}
+
+	// Search the token list by name
+	if config.name != "" {
+		tokens, err := tokenMap.SearchName(config.name)
+		if err != nil {
+			fatalf(exitNotFound, "❌ Failed to search token names: %v", err)
+		}
+		selectedTokens = append(selectedTokens, selectToken(tokens, fmt.Sprintf("named like %q", config.name),
+			"--mint=<mint_address> --ticker=<token_symbol>", config.interactive))
+	}
+
+	// Get token addresses from Raydium API using provided tickers
+	for _, ticker := range tickers {
+		tokens, err := findTokens(ticker, tokenMap, config.exact)
+		if err != nil {
+			fatalf(exitNotFound, "❌ Failed to get %s token address: %v", ticker, err)
+		}
+
+		selectedTokens = append(selectedTokens, selectToken(tokens, "with symbol "+ticker,
+			fmt.Sprintf("--mint=<mint_address> --ticker=%s", ticker), config.interactive))
+	}
+
+	var quoteToken *pooltrim.TokenInfo
+	if config.quoteTicker != "" {
+		// Get quote token address from Raydium API using provided quote ticker
+		tokens, err := findTokens(config.quoteTicker, tokenMap, config.exact)
+		if err != nil {
+			fatalf(exitNotFound, "❌ Failed to get %s quote token address: %v", config.quoteTicker, err)
+		}
+
+		quoteToken = selectToken(tokens, "with symbol "+config.quoteTicker, "--quote-mint=<mint_address>", config.interactive)
+	} else {
+		if len(quoteMints) == 0 {
+			quoteMints = []string{pooltrim.DefaultQuoteMint}
+		}
+		quoteToken = pooltrim.QuoteTokenInfo(quoteMints[0])
+	}
+	if err := pooltrim.ValidateMint(quoteToken.Mint); err != nil {
+		fatalf(exitUsage, "❌ Error: quote token %s: %v", quoteToken.Symbol, err)
+	}
+	config.quoteMint = quoteToken.Mint
+	phases.mark("token resolution")
+
+	for _, token := range selectedTokens {
+		logf("Base Token (%s): %s\n", token.Symbol, token.Mint)
+	}
+	// quoteLabel names the quote side in messages
+	quoteLabel := quoteToken.Symbol
+	switch {
+	case multiQuote:
+		var symbols []string
+		for _, mint := range quoteMints {
+			quote := pooltrim.QuoteTokenInfo(mint)
+			logf("Quote Token (%s): %s\n", quote.Symbol, quote.Mint)
+			symbols = append(symbols, quote.Symbol)
+		}
+		logf("\n")
+		quoteLabel = strings.Join(symbols, "|")
+	case config.anyQuote:
+		quoteLabel = "any"
+		logf("Quote Token: any\n\n")
+	default:
+		logf("Quote Token (%s): %s\n\n", quoteToken.Symbol, quoteToken.Mint)
+	}
+
+	// Describe this run in the output
+	generatedAt := time.Now().UTC()
+	writeOpts.Metadata = &pooltrim.OutputMetadata{
+		GeneratedAt: &generatedAt,
+		Version:     version,
+		Filters:     filterFlagValues(),
+	}
+	switch {
+	case multiQuote:
+		writeOpts.Metadata.QuoteMints = quoteMints
+	case !config.anyQuote:
+		writeOpts.Metadata.QuoteMints = []string{quoteToken.Mint}
+	}
+
+	// Several snapshots are filtered side by side into entries tagged with
+	// their file
+	if len(config.inputFiles) > 1 {
+		if config.anyQuote && tokenMap == nil {
+			tokenMap, _ = loadCounterTokens(ctx, dl, cache, config)
+		}
+		empty := filterSnapshots(ctx, &config, writeOpts, filter, selectedTokens, quoteToken, tokenMap)
+		phases.mark("pool scan + write")
+		if config.bench {
+			phases.print()
+		}
+		if config.benchJSON != "" {
+			if err := phases.writeJSON(config.benchJSON); err != nil {
+				fatalf(exitFailure, "❌ Failed to write phase timings: %v", err)
+			}
+		}
+		if config.tokenFile == "" && tokenFilePath != "" {
+			logf("\n💡 Tip: Use --token-file=%s next time to skip downloading token list\n", tokenFilePath)
+		}
+		if config.failOnEmpty && empty {
+			fatalf(exitNoPools, "❌ Some files have no pools for the requested tokens")
+		}
+		return
+	}
 
 	var jsonFilePath string
+	var pools map[string][]pooltrim.RaydiumPool
+	var stats *pooltrim.ScanStats
 
-	if config.inputFile != "" {
-		if !fileExists(config.inputFile) {
-			log.Fatalf("❌ Provided file does not exist: %s", config.inputFile)
+	if config.inputFile == pooltrim.StdinPath {
+		// Stdin can only be read once, so the scan itself is the validation:
+		// malformed JSON fails it
+		jsonFilePath = config.inputFile
+		logf("Reading pools from stdin\n")
+		if config.strictValidate {
+			warnf("⚠️  Strict validation skipped: the pools are read from stdin\n")
+		}
+
+		pools, stats, err = pooltrim.ProcessPoolsFile(ctx, jsonFilePath, selectedTokens, quoteToken, filter)
+		if err != nil {
+			fatalf(failureCode(err), "❌ Failed to process pools from stdin: %v", err)
+		}
+		phases.mark("pool scan")
+	} else if config.inputFile != "" {
+		if !pooltrim.FileExists(config.inputFile) {
+			fatalf(exitUsage, "❌ Provided file does not exist: %s", config.inputFile)
 		}
 		jsonFilePath = config.inputFile
-		fmt.Printf("Using provided file: %s\n", jsonFilePath)
+		logf("Using provided file: %s\n", jsonFilePath)
+
+		if err := validatePools(jsonFilePath); err != nil {
+			fatalf(exitValidation, "❌ Invalid JSON file: %v", err)
+		}
+		if config.strictValidate {
+			if err := pooltrim.CheckPoolFields(jsonFilePath, config.maxInvalidRatio); err != nil {
+				fatalf(exitValidation, "❌ Strict validation failed: %v", err)
+			}
+		}
+		phases.mark("validation")
+
+		pools, stats, err = pooltrim.ProcessPoolsFile(ctx, jsonFilePath, selectedTokens, quoteToken, filter)
+		if err != nil {
+			fatalf(failureCode(err), "❌ Failed to process pools: %v", err)
+		}
+		phases.mark("pool scan")
 	} else {
-		if err := os.MkdirAll("tmp", 0o755); err != nil {
-			log.Fatalf("❌ Failed to create tmp directory: %v", err)
+		// Filter the pools while they download instead of reading the file back
+		jsonFilePath, err = cache.Stream(ctx, dl, config.poolURL, pooltrim.PoolsCacheFile, config.sha256, validatePools, func(reader io.Reader) error {
+			var err error
+			pools, stats, err = pooltrim.ProcessPools(ctx, reader, selectedTokens, quoteToken, filter)
+			return err
+		})
+		if err != nil {
+			fatalf(failureCode(err), "❌ Failed to process pools: %v", err)
+		}
+		// The download is scanned as it arrives, so both share one timing
+		phases.mark("download + pool scan")
+
+		// The stream is filtered as it arrives, so the complete file can only
+		// be checked afterwards
+		if config.strictValidate {
+			if jsonFilePath == "" {
+				warnf("⚠️  Strict validation skipped: the download was not cached\n")
+			} else if err := pooltrim.CheckPoolFields(jsonFilePath, config.maxInvalidRatio); err != nil {
+				fatalf(exitValidation, "❌ Strict validation failed: %v", err)
+			}
+			phases.mark("validation")
+		}
+	}
+
+	// Record the pool list the output was built from
+	if config.inputFile != "" {
+		writeOpts.Metadata.Source = &pooltrim.SourceInfo{File: config.inputFile}
+	} else if source, ok := cache.Source(config.poolURL); ok {
+		writeOpts.Metadata.Source = &source
+	}
+
+	if config.statsJSON != "" {
+		if err := writeStats(config.statsJSON, stats); err != nil {
+			fatalf(exitFailure, "❌ Failed to write stats: %v", err)
+		}
+	}
+
+	if marketOnly {
+		if config.tokenFile != "" {
+			if tokenMap, err = pooltrim.LoadTokenMap(config.tokenFile, config.strictSchema); err != nil {
+				fatalf(failureCode(err), "❌ Failed to read token list: %v", err)
+			}
+		}
+		selectedTokens, quoteToken = marketTokens(pools, tokenMap)
+		if len(selectedTokens) == 0 {
+			fatalf(exitNoPools, "❌ No pool found on market %s", config.marketID)
+		}
+	}
+
+	if config.withReserves || config.minLiquidity > 0 || config.withPrice {
+		rpc := &pooltrim.RPCClient{
+			Client:            newHTTPClient(config.httpTimeout, proxyURL),
+			URL:               config.rpcURL,
+			BatchSize:         config.rpcBatchSize,
+			RequestsPerSecond: config.rpcRate,
+			Concurrency:       config.rpcConcurrency,
+			MaxRetries:        config.maxRetries,
+		}
+		if config.reservesTTL > 0 {
+			if rpc.Cache, err = pooltrim.NewBalanceCache(config.reservesTTL, config.refreshReserves); err != nil {
+				fatalf(exitUsage, "❌ Failed to set up balance cache: %v", err)
+			}
+		}
+		if err := rpc.FetchReserves(ctx, pools); err != nil {
+			fatalf(exitDownload, "❌ Failed to fetch reserves: %v", err)
+		}
+
+		if config.minLiquidity > 0 {
+			removed := pooltrim.FilterByLiquidity(pools, config.minLiquidity)
+			logf("  Filtered by liquidity: %d pools below %g %s\n", removed, config.minLiquidity, quoteLabel)
+		}
+		if config.withPrice {
+			pooltrim.AttachPrices(pools)
+		}
+		phases.mark("reserves")
+	}
+
+	// Warn about tokens without pools, which usually means a typo or a delisted token
+	var emptyTokens []string
+	for _, token := range selectedTokens {
+		if len(pools[token.Mint]) == 0 {
+			warnf("⚠️  No %s/%s pools found\n", token.Symbol, quoteLabel)
+			emptyTokens = append(emptyTokens, token.Symbol)
 		}
+	}
 
-		jsonFilePath = filepath.Join("tmp", fmt.Sprintf("raydium-pools-%d.json", time.Now().UnixNano()))
+	orderPools(&config, pools)
+	var ranked []pooltrim.RankedPool
+	if config.top > 0 {
+		ranked = pooltrim.TopPools(pools, config.top)
+		printRanking(ranked, selectedTokens)
+	}
 
-		if err := downloadFile(raydiumURL, jsonFilePath); err != nil {
-			log.Fatalf("❌ Download failed: %v", err)
+	if config.summaryOnly {
+		totalPools := 0
+		for _, token := range selectedTokens {
+			totalPools += len(pools[token.Mint])
+		}
+		logf("\n📝 Summary only: matched %d pools for %d tokens, nothing written\n", totalPools, len(selectedTokens))
+		if config.bench {
+			phases.print()
+		}
+		if config.benchJSON != "" {
+			if err := phases.writeJSON(config.benchJSON); err != nil {
+				fatalf(exitFailure, "❌ Failed to write phase timings: %v", err)
+			}
+		}
+		if config.failOnEmpty && len(emptyTokens) > 0 {
+			fatalf(exitNoPools, "❌ No pools found for %s", strings.Join(emptyTokens, ", "))
 		}
+		return
 	}
 
-	if err := validateJSON(jsonFilePath); err != nil {
-		if config.inputFile == "" {
-			os.Remove(jsonFilePath)
+	if config.backup && !config.dryRun && config.output != pooltrim.StdoutPath && pooltrim.FileExists(config.output) {
+		backupPath, err := pooltrim.BackupFile(config.output)
+		if err != nil {
+			fatalf(exitFailure, "❌ Failed to back up output file: %v", err)
 		}
-		log.Fatalf("❌ Invalid JSON file: %v", err)
+		logf("💾 Backed up %s to %s\n", config.output, backupPath)
+	}
+
+	// Name the counter tokens of --any-quote pairs, leaving unknown mints as is
+	if config.anyQuote && (config.format == "json" || config.splitOutput != "") && tokenMap == nil {
+		tokenMap, tokenFilePath = loadCounterTokens(ctx, dl, cache, config)
 	}
 
-	pools, err := processPoolsFile(jsonFilePath, config.mint, config.ticker)
+	// With --any-quote each counter token gets its own entry, recording the
+	// actual pair
+	entries := pooltrim.PoolEntries(selectedTokens, quoteToken, pools)
+	if config.anyQuote {
+		entries = pooltrim.QuoteEntries(selectedTokens, pools, tokenMap)
+	}
+
+	switch {
+	case config.dryRun && (config.format != "json" || config.flatOutput):
+		totalPools := 0
+		for _, token := range selectedTokens {
+			totalPools += len(pools[token.Mint])
+		}
+		logf("\n📝 Dry run: would write %d pools for %d tokens to %s\n", totalPools, len(selectedTokens), config.output)
+	case config.dryRun:
+		err = pooltrim.PreviewPoolEntries(config.output, entries, writeOpts)
+	case config.format == "csv":
+		err = pooltrim.WriteFilteredPoolsCSV(config.output, selectedTokens, pools, writeOpts)
+	case config.format == "ndjson":
+		err = pooltrim.WriteFilteredPoolsNDJSON(config.output, selectedTokens, pools, writeOpts)
+	case config.top > 0 && config.flatOutput:
+		err = pooltrim.WriteRankedPools(config.output, ranked, selectedTokens, writeOpts)
+	case config.flatOutput:
+		err = pooltrim.WriteFilteredPoolsFlat(config.output, selectedTokens, pools, config.flatSymbol, writeOpts)
+	default:
+		err = pooltrim.WritePoolEntries(config.output, entries, writeOpts)
+	}
+	var corrupt *pooltrim.CorruptOutputError
+	if errors.As(err, &corrupt) {
+		fatalf(exitValidation, "❌ Failed to write filtered pools: %v. Rerun with --recover to move it to %s.corrupt and start a fresh file, or --force to replace it", err, corrupt.Path)
+	}
 	if err != nil {
-		if config.inputFile == "" {
-			os.Remove(jsonFilePath)
+		fatalf(outputFailureCode(err), "❌ Failed to write filtered pools: %v", err)
+	}
+
+	if config.splitOutput != "" {
+		if config.dryRun {
+			logf("📝 Dry run: would write %d per-token files to %s\n", len(entries), config.splitOutput)
+		} else if err := pooltrim.WriteSplitEntries(config.splitOutput, entries, writeOpts); err != nil {
+			fatalf(exitFailure, "❌ Failed to write per-token files: %v", err)
+		}
+	}
+	phases.mark("write")
+
+	if config.bench {
+		phases.print()
+	}
+	if config.benchJSON != "" {
+		if err := phases.writeJSON(config.benchJSON); err != nil {
+			fatalf(exitFailure, "❌ Failed to write phase timings: %v", err)
 		}
-		log.Fatalf("❌ Failed to process pools: %v", err)
 	}
 
-	if err := writeFilteredPools(selectedToken, pools); err != nil {
-		log.Fatalf("❌ Failed to write filtered pools: %v", err)
+	if config.inputFile == "" && jsonFilePath != "" {
+		logf("\n💡 Tip: Use --file=%s next time to skip downloading\n", jsonFilePath)
+	}
+	if config.tokenFile == "" && tokenFilePath != "" {
+		logf("💡 Tip: Use --token-file=%s next time to skip downloading token list\n", tokenFilePath)
 	}
 
-	if config.inputFile == "" {
-		fmt.Printf("\n💡 Tip: Use --file=%s next time to skip downloading\n", jsonFilePath)
+	if config.metricsFile != "" {
+		matched := 0
+		for _, token := range selectedTokens {
+			matched += len(pools[token.Mint])
+		}
+		if err := writeMetrics(config.metricsFile, stats, matched, time.Since(start)); err != nil {
+			fatalf(exitFailure, "❌ Failed to write metrics: %v", err)
+		}
 	}
-	if config.tokenFile == "" && fileExists(filepath.Join("tmp", fmt.Sprintf("raydium-tokens-%d.json", time.Now().UnixNano()))) {
-		fmt.Printf("💡 Tip: Use --token-file=%s next time to skip downloading token list\n", filepath.Join("tmp", fmt.Sprintf("raydium-tokens-%d.json", time.Now().UnixNano())))
+
+	if config.failOnEmpty && len(emptyTokens) > 0 {
+		fatalf(exitNoPools, "❌ No pools found for %s", strings.Join(emptyTokens, ", "))
 	}
 }
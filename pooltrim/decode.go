@@ -0,0 +1,164 @@
+package pooltrim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxBadPoolWarnings caps the skipped pools logged one by one; the rest are
+// only counted
+const maxBadPoolWarnings = 10
+
+// knownPoolFields are the JSON names of the fields RaydiumPool decodes
+var knownPoolFields = func() map[string]bool {
+	known := make(map[string]bool, len(poolFieldNames))
+	for _, name := range poolFieldNames {
+		known[name] = true
+	}
+	return known
+}()
+
+// plainPool is RaydiumPool without its JSON methods
+type plainPool RaydiumPool
+
+// lenientPool decodes the integer fields of a pool from numbers or strings
+// holding numbers, which Raydium sometimes sends instead
+type lenientPool struct {
+	*plainPool
+	Version       lenientInt `json:"version"`
+	BaseDecimals  lenientInt `json:"baseDecimals"`
+	QuoteDecimals lenientInt `json:"quoteDecimals"`
+	LPDecimals    lenientInt `json:"lpDecimals"`
+	MarketVersion lenientInt `json:"marketVersion"`
+}
+
+// lenientInt is an integer encoded as a JSON number or string
+type lenientInt int
+
+func (n *lenientInt) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return json.Unmarshal(data, (*int)(n))
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		return fmt.Errorf("invalid number %q: %w", text, err)
+	}
+	*n = lenientInt(value)
+	return nil
+}
+
+// fieldTypeError describes a mistyped pool field without the internal types
+// decoded into, and still unwraps to the *json.UnmarshalTypeError
+type fieldTypeError struct {
+	err *json.UnmarshalTypeError
+}
+
+func (e *fieldTypeError) Error() string {
+	return fmt.Sprintf("field %s: cannot decode %s as %s", e.err.Field, e.err.Value, e.err.Type)
+}
+
+func (e *fieldTypeError) Unwrap() error {
+	return e.err
+}
+
+// poolError names the pool and field that failed to decode
+func poolError(data []byte, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		err = &fieldTypeError{err: typeErr}
+	}
+	var pool struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(data, &pool) == nil && pool.ID != "" {
+		return fmt.Errorf("pool %s: %w", pool.ID, err)
+	}
+	return err
+}
+
+// UnmarshalJSON decodes a pool, accepting integer fields encoded as strings.
+// Fields it does not know about are collected in Extra
+func (p *RaydiumPool) UnmarshalJSON(data []byte) error {
+	if err := p.decodeKnown(data); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		if knownPoolFields[name] {
+			continue
+		}
+		if p.Extra == nil {
+			p.Extra = make(map[string]json.RawMessage)
+		}
+		p.Extra[name] = value
+	}
+	return nil
+}
+
+// decodeKnown decodes the fields RaydiumPool knows about, accepting integer
+// fields encoded as strings, and leaves Extra empty. Unlike UnmarshalJSON it
+// decodes the pool only once
+func (p *RaydiumPool) decodeKnown(data []byte) error {
+	err := json.Unmarshal(data, (*plainPool)(p))
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		// Only pools with mistyped fields pay for the lenient decoding
+		*p = RaydiumPool{}
+		lenient := lenientPool{plainPool: (*plainPool)(p)}
+		if err = json.Unmarshal(data, &lenient); err == nil {
+			p.Version = int(lenient.Version)
+			p.BaseDecimals = int(lenient.BaseDecimals)
+			p.QuoteDecimals = int(lenient.QuoteDecimals)
+			p.LPDecimals = int(lenient.LPDecimals)
+			p.MarketVersion = int(lenient.MarketVersion)
+		}
+	}
+	if err != nil {
+		return poolError(data, err)
+	}
+	p.Extra = nil
+	return nil
+}
+
+// MarshalJSON encodes a pool followed by its Extra fields in name order
+func (p RaydiumPool) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(plainPool(p))
+	if err != nil || len(p.Extra) == 0 {
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1])
+	for _, name := range sortedKeys(p.Extra) {
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(p.Extra[name])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
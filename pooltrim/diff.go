@@ -0,0 +1,152 @@
+package pooltrim
+
+import (
+	"bytes"
+	"slices"
+)
+
+// PoolChange is a pool stored in both output files with different values
+type PoolChange struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"` // JSON names of the fields that differ
+}
+
+// EntryDiff lists the pools added, removed and changed between two output
+// files for one token/quote pair, by pool ID
+type EntryDiff struct {
+	Symbol  string       `json:"symbol"`
+	Mint    string       `json:"mint"`
+	Quote   string       `json:"quote"`
+	File    string       `json:"file,omitempty"`
+	Added   []string     `json:"added"`
+	Removed []string     `json:"removed"`
+	Changed []PoolChange `json:"changed"`
+}
+
+// Empty reports whether the pair's pools are the same in both files
+func (d EntryDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffOutputFiles compares two output files written by WriteFilteredPools.
+// Entries are matched by token mint, quote and file, so a token whose entry
+// is only in one file has all its pools added or removed. Only pairs whose
+// pools differ are returned, in the order of the new file followed by the
+// pairs it dropped
+func DiffOutputFiles(oldPath, newPath string) ([]EntryDiff, error) {
+	oldList, err := ReadOutputFile(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	newList, err := ReadOutputFile(newPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sameEntry := func(a TokenPoolInfo) func(TokenPoolInfo) bool {
+		return func(b TokenPoolInfo) bool {
+			return a.Token.Mint == b.Token.Mint && a.QuoteMint() == b.QuoteMint() && a.File == b.File
+		}
+	}
+
+	var diffs []EntryDiff
+	for _, entry := range newList.Tokens {
+		var previous []RaydiumPool
+		if i := slices.IndexFunc(oldList.Tokens, sameEntry(entry)); i >= 0 {
+			previous = oldList.Tokens[i].Pools
+		}
+		diff, err := diffEntry(entry, previous, entry.Pools)
+		if err != nil {
+			return nil, err
+		}
+		if !diff.Empty() {
+			diffs = append(diffs, diff)
+		}
+	}
+	for _, entry := range oldList.Tokens {
+		if slices.ContainsFunc(newList.Tokens, sameEntry(entry)) {
+			continue
+		}
+		diff, err := diffEntry(entry, entry.Pools, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !diff.Empty() {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
+
+// diffEntry compares the old and new pools of an entry by pool ID
+func diffEntry(entry TokenPoolInfo, oldPools, newPools []RaydiumPool) (EntryDiff, error) {
+	quote := QuoteTokenInfo(entry.QuoteMint())
+	if entry.Quote != nil {
+		quote = entry.Quote
+	}
+	diff := EntryDiff{
+		Symbol:  entry.Token.Symbol,
+		Mint:    entry.Token.Mint,
+		Quote:   quote.Symbol,
+		File:    entry.File,
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []PoolChange{},
+	}
+
+	oldByID := make(map[string]RaydiumPool, len(oldPools))
+	for _, pool := range oldPools {
+		oldByID[pool.ID] = pool
+	}
+	newIDs := make(map[string]bool, len(newPools))
+	for _, pool := range newPools {
+		newIDs[pool.ID] = true
+		previous, ok := oldByID[pool.ID]
+		if !ok {
+			diff.Added = append(diff.Added, pool.ID)
+			continue
+		}
+		fields, err := changedFields(previous, pool)
+		if err != nil {
+			return diff, err
+		}
+		if len(fields) > 0 {
+			diff.Changed = append(diff.Changed, PoolChange{ID: pool.ID, Fields: fields})
+		}
+	}
+	for _, pool := range oldPools {
+		if !newIDs[pool.ID] {
+			diff.Removed = append(diff.Removed, pool.ID)
+		}
+	}
+	return diff, nil
+}
+
+// changedFields returns the JSON names of the fields that differ between two
+// versions of a pool, in field order. A field set in only one of them, such
+// as reserves, counts as changed
+func changedFields(oldPool, newPool RaydiumPool) ([]string, error) {
+	oldValues, err := poolValues(oldPool)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := poolValues(newPool)
+	if err != nil {
+		return nil, err
+	}
+
+	names := slices.Clone(poolFieldNames)
+	for _, name := range append(sortedKeys(oldPool.Extra), sortedKeys(newPool.Extra)...) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	var fields []string
+	for _, name := range names {
+		if !bytes.Equal(oldValues[name], newValues[name]) {
+			fields = append(fields, name)
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,109 @@
+package pooltrim
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDiffOutputFiles(t *testing.T) {
+	bonk := `"token":{"symbol":"BONK","mint":"` + testBonkMint + `"}`
+	wif := `"token":{"symbol":"WIF","mint":"` + testWifMint + `"}`
+	usdc := `"quote":{"symbol":"USDC","mint":"` + testUSDCMint + `"}`
+
+	tests := []struct {
+		name     string
+		old, new string
+		want     []EntryDiff
+	}{
+		{
+			name: "identical",
+			old:  `{"tokens":[{` + bonk + `,"pools":[{"id":"a","version":4}]}]}`,
+			new:  `{"tokens":[{` + bonk + `,"pools":[{"id":"a","version":4}]}]}`,
+		},
+		{
+			name: "added, removed and changed pools",
+			old:  `{"tokens":[{` + bonk + `,"pools":[{"id":"a","version":4},{"id":"b"},{"id":"c","lpVault":"x"}]}]}`,
+			new:  `{"tokens":[{` + bonk + `,"pools":[{"id":"a","version":5,"baseReserve":1},{"id":"c","lpVault":"y"},{"id":"d"}]}]}`,
+			want: []EntryDiff{{
+				Symbol:  "BONK",
+				Mint:    testBonkMint,
+				Quote:   "SOL",
+				Added:   []string{"d"},
+				Removed: []string{"b"},
+				Changed: []PoolChange{{ID: "a", Fields: []string{"version", "baseReserve"}}, {ID: "c", Fields: []string{"lpVault"}}},
+			}},
+		},
+		{
+			name: "entries only in one file",
+			old:  `{"tokens":[{` + bonk + `,"pools":[{"id":"a"}]},{` + wif + `,"pools":[{"id":"w"}]}]}`,
+			new:  `{"tokens":[{` + bonk + `,"pools":[{"id":"a"}]},{` + bonk + `,` + usdc + `,"pools":[{"id":"u"}]}]}`,
+			want: []EntryDiff{
+				{Symbol: "BONK", Mint: testBonkMint, Quote: "USDC", Added: []string{"u"}, Removed: []string{}, Changed: []PoolChange{}},
+				{Symbol: "WIF", Mint: testWifMint, Quote: "SOL", Added: []string{}, Removed: []string{"w"}, Changed: []PoolChange{}},
+			},
+		},
+		{
+			name: "entries matched by file",
+			old:  `{"tokens":[{` + bonk + `,"file":"mon.json","pools":[{"id":"a"}]}]}`,
+			new:  `{"tokens":[{` + bonk + `,"file":"mon.json","pools":[{"id":"a"}]},{` + bonk + `,"file":"tue.json","pools":[{"id":"a"}]}]}`,
+			want: []EntryDiff{
+				{Symbol: "BONK", Mint: testBonkMint, Quote: "SOL", File: "tue.json", Added: []string{"a"}, Removed: []string{}, Changed: []PoolChange{}},
+			},
+		},
+		{
+			name: "legacy old file",
+			old:  `{` + bonk + `,"pools":[{"id":"a"}]}`,
+			new:  `{"tokens":[{` + bonk + `,"pools":[{"id":"a"},{"id":"b"}]}]}`,
+			want: []EntryDiff{
+				{Symbol: "BONK", Mint: testBonkMint, Quote: "SOL", Added: []string{"b"}, Removed: []string{}, Changed: []PoolChange{}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			oldPath, newPath := filepath.Join(dir, "old.json"), filepath.Join(dir, "new.json")
+			if err := os.WriteFile(oldPath, []byte(tt.old), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(newPath, []byte(tt.new), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := DiffOutputFiles(oldPath, newPath)
+			if err != nil {
+				t.Fatalf("DiffOutputFiles() error = %v", err)
+			}
+			if !slices.EqualFunc(got, tt.want, equalEntryDiff) {
+				t.Errorf("DiffOutputFiles() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffOutputFilesCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old.json"), filepath.Join(dir, "new.json")
+	if err := os.WriteFile(oldPath, []byte(`{"tokens":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newPath, []byte(`not json`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var corrupt *CorruptOutputError
+	if _, err := DiffOutputFiles(oldPath, newPath); !errors.As(err, &corrupt) || corrupt.Path != newPath {
+		t.Errorf("DiffOutputFiles() error = %v, want a *CorruptOutputError for %s", err, newPath)
+	}
+}
+
+func equalEntryDiff(a, b EntryDiff) bool {
+	return a.Symbol == b.Symbol && a.Mint == b.Mint && a.Quote == b.Quote && a.File == b.File &&
+		slices.Equal(a.Added, b.Added) && slices.Equal(a.Removed, b.Removed) &&
+		slices.EqualFunc(a.Changed, b.Changed, func(x, y PoolChange) bool {
+			return x.ID == y.ID && slices.Equal(x.Fields, y.Fields)
+		})
+}
@@ -0,0 +1,692 @@
+package pooltrim
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cacheName = "raydium-pool-trim"
+
+	// PoolsCacheFile and TokensCacheFile name the downloaded pool and token
+	// lists; temp downloads share their prefix
+	PoolsCacheFile  = "raydium-pools.json"
+	TokensCacheFile = "raydium-tokens.json"
+
+	// BalancesCacheFile holds the cached vault balances fetched over RPC
+	BalancesCacheFile = "raydium-balances.json"
+)
+
+// Downloader fetches remote files into a download directory
+type Downloader struct {
+	Client     *http.Client
+	Dir        string
+	MaxRetries int
+	Offline    bool   // Refuse to download anything
+	UserAgent  string // User-Agent header sent with each request, Go's default when empty
+
+	// SkipSpaceCheck disables comparing the Content-Length of a download
+	// against the free space of the directory it is written to
+	SkipSpaceCheck bool
+}
+
+// StatusError reports an unexpected HTTP status code
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration // Delay requested by a Retry-After header, 0 if none
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned status code %d", e.Code)
+}
+
+// DownloadError reports a file that could not be fetched, after any retries
+type DownloadError struct {
+	URL string
+	Err error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("failed to download %s: %v", e.URL, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError reports a downloaded file that failed validation or did
+// not match its expected checksum
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// retryable reports whether a failed download may succeed when retried.
+// Network errors and 5xx responses are retryable, other statuses are not
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= http.StatusInternalServerError
+	}
+	var spaceErr *DiskSpaceError
+	return !errors.As(err, &spaceErr)
+}
+
+// DiskSpaceError reports a download larger than the free space left in the
+// directory it would be written to
+type DiskSpaceError struct {
+	Dir  string
+	Need int64
+	Free uint64
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space in %s: the download needs %.1f MB but only %.1f MB is free",
+		e.Dir, float64(e.Need)/(1024*1024), float64(e.Free)/(1024*1024))
+}
+
+// checkSpace fails with a *DiskSpaceError when dir has less free space than
+// a download of size bytes needs. Unknown sizes and unknown free space pass
+func (d *Downloader) checkSpace(dir string, size int64) error {
+	if d.SkipSpaceCheck || size <= 0 {
+		return nil
+	}
+	free, ok := freeSpace(dir)
+	if !ok || free >= uint64(size) {
+		return nil
+	}
+	return &DiskSpaceError{Dir: dir, Need: size, Free: free}
+}
+
+// DownloadFile downloads a file into a new temp file in the download directory and
+// shows progress. The pattern is passed to os.CreateTemp, so concurrent runs
+// never share a file. Network errors and 5xx responses are retried with
+// exponential backoff. The SHA-256 of the content is computed while streaming
+// and checked against expectedSHA256 when one is given. It returns the path
+// of the downloaded file
+func (d *Downloader) DownloadFile(ctx context.Context, url, pattern, expectedSHA256 string) (string, error) {
+	path, _, err := d.downloadFile(ctx, url, pattern, expectedSHA256, SourceInfo{})
+	return path, err
+}
+
+// downloadFile is DownloadFile sending the conditional headers of cond. It
+// also returns the source headers of the response. An unchanged file fails
+// with a 304 *StatusError
+func (d *Downloader) downloadFile(ctx context.Context, url, pattern, expectedSHA256 string, cond SourceInfo) (string, SourceInfo, error) {
+	var source SourceInfo
+	if d.Offline {
+		return "", source, &DownloadError{URL: url, Err: errors.New("offline mode")}
+	}
+
+	if err := os.MkdirAll(d.Dir, 0o755); err != nil {
+		return "", source, fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	// Create the file
+	out, err := os.CreateTemp(d.Dir, pattern)
+	if err != nil {
+		return "", source, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	err = d.retry(ctx, "Downloading", url, func() error {
+		// Start each attempt with an empty file
+		if err := out.Truncate(0); err != nil {
+			return fmt.Errorf("failed to reset temp file: %w", err)
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to reset temp file: %w", err)
+		}
+
+		hash.Reset()
+		var err error
+		source, err = d.download(ctx, url, d.Dir, io.MultiWriter(out, hash), cond)
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		err = &DownloadError{URL: url, Err: err}
+	}
+	if err == nil {
+		err = verifyChecksum(hash, expectedSHA256)
+	}
+
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", source, err
+	}
+	return out.Name(), source, nil
+}
+
+// retry runs op until it succeeds, retrying network errors and 5xx
+// responses with exponential backoff
+func (d *Downloader) retry(ctx context.Context, action, url string, op func() error) error {
+	attempts := d.MaxRetries + 1
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		logf("⬇️  %s %s (attempt %d/%d)\n", action, url, attempt, attempts)
+
+		err := op()
+		if err == nil || attempt >= attempts || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		warnf("⚠️  Attempt %d/%d failed: %v, retrying in %s\n", attempt, attempts, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+// verifyChecksum checks the digest in h against expectedSHA256, or prints
+// it when no checksum is expected
+func verifyChecksum(h hash.Hash, expectedSHA256 string) error {
+	digest := hex.EncodeToString(h.Sum(nil))
+	if expectedSHA256 == "" {
+		logf("🔑 SHA-256: %s\n", digest)
+		return nil
+	}
+	if !strings.EqualFold(digest, expectedSHA256) {
+		return &ValidationError{Err: fmt.Errorf("checksum mismatch: expected SHA-256 %s, got %s", expectedSHA256, digest)}
+	}
+	logf("✅ SHA-256 verified: %s\n", digest)
+	return nil
+}
+
+// open requests url and returns the decompressed response body with its
+// size, or -1 when the size is unknown, and its source headers. The ETag and
+// Last-Modified of cond are sent as conditional headers, so an unchanged
+// file fails with a 304 *StatusError
+func (d *Downloader) open(ctx context.Context, url string, cond SourceInfo) (io.ReadCloser, int64, SourceInfo, error) {
+	source := SourceInfo{URL: url}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, source, fmt.Errorf("failed to create request: %w", err)
+	}
+	if d.UserAgent != "" {
+		req.Header.Set("User-Agent", d.UserAgent)
+	}
+	if cond.ETag != "" {
+		req.Header.Set("If-None-Match", cond.ETag)
+	}
+	if cond.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cond.LastModified)
+	}
+
+	// Get the data
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, 0, source, fmt.Errorf("failed to download file: %w", err)
+	}
+
+	// Check if we got a successful response
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, source, &StatusError{Code: resp.StatusCode}
+	}
+	source.ETag = resp.Header.Get("ETag")
+	source.LastModified = resp.Header.Get("Last-Modified")
+
+	// The transport only decompresses responses it asked to be compressed
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Uncompressed {
+		return resp.Body, resp.ContentLength, source, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, source, fmt.Errorf("failed to read gzip response: %w", err)
+	}
+	// Content-Length counts compressed bytes, which says nothing about the
+	// decompressed size
+	return readCloser{Reader: gz, close: func() error {
+		gz.Close()
+		return resp.Body.Close()
+	}}, -1, source, nil
+}
+
+// notModified reports whether err is a 304 response to a conditional request
+func notModified(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotModified
+}
+
+// download streams the body of url into out, a file in dir, and shows
+// progress. It fails before reading the body when dir lacks the space for it.
+// It returns the source headers of the response
+func (d *Downloader) download(ctx context.Context, url, dir string, out io.Writer, cond SourceInfo) (SourceInfo, error) {
+	body, size, source, err := d.open(ctx, url, cond)
+	if err != nil {
+		return source, err
+	}
+	defer body.Close()
+	if err := d.checkSpace(dir, size); err != nil {
+		return source, err
+	}
+
+	// Create a buffer for reading chunks
+	buf := make([]byte, 32*1024) // 32KB chunks
+	progress := newProgressReader(body, size)
+	for {
+		n, err := progress.Read(buf)
+		if n > 0 {
+			if _, werr := out.Write(buf[:n]); werr != nil {
+				return source, fmt.Errorf("error writing to file: %w", werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return source, fmt.Errorf("error reading from response: %w", err)
+		}
+	}
+	progress.done()
+
+	return source, nil
+}
+
+// streamingDownload is set while Stream passes a download to its process
+// callback, which then leaves progress updates to the download
+var streamingDownload atomic.Bool
+
+// progressReader shows the progress of a download as its body is read
+type progressReader struct {
+	r         io.Reader
+	size      int64 // Content length, or -1 when unknown
+	read      int64
+	start     time.Time
+	lastPrint time.Time
+	err       error // First error reading r other than io.EOF
+}
+
+func newProgressReader(r io.Reader, size int64) *progressReader {
+	now := time.Now()
+	return &progressReader{r: r, size: size, start: now, lastPrint: now}
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+	if err != nil && err != io.EOF && p.err == nil {
+		p.err = err
+	}
+
+	// Update progress every 500ms
+	if n > 0 && time.Since(p.lastPrint) >= 500*time.Millisecond {
+		progressf("%s", downloadProgress(p.read, p.size, time.Since(p.start)))
+		p.lastPrint = time.Now()
+	}
+	return n, err
+}
+
+// done replaces the progress line with the total downloaded
+func (p *progressReader) done() {
+	progressDonef("Downloaded %.1f MB in %s%s\n", float64(p.read)/(1024*1024), time.Since(p.start).Round(time.Second), strings.Repeat(" ", 40))
+}
+
+// progressBarWidth is the number of cells in the download progress bar
+const progressBarWidth = 30
+
+// downloadProgress renders a progress line for a download. With a known size
+// it shows a bar, the percentage and an ETA based on the throughput so far,
+// otherwise only the downloaded amount
+func downloadProgress(done, size int64, elapsed time.Duration) string {
+	mb := float64(done) / (1024 * 1024)
+	if size <= 0 {
+		return fmt.Sprintf("Downloading... %.1f MB    ", mb)
+	}
+
+	fraction := min(float64(done)/float64(size), 1)
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled)
+
+	eta := "--"
+	if done > 0 && elapsed > 0 {
+		remaining := time.Duration(float64(elapsed) * float64(size-done) / float64(done))
+		eta = remaining.Round(time.Second).String()
+	}
+	return fmt.Sprintf("Downloading [%s] %3.0f%% %.1f/%.1f MB, ETA %s    ", bar, fraction*100, mb, float64(size)/(1024*1024), eta)
+}
+
+// FileCache keeps downloaded files under a stable name so later runs can
+// reuse them while they are younger than the TTL
+type FileCache struct {
+	Dir     string
+	TTL     time.Duration // Zero disables caching
+	Refresh bool          // Ignore cached files
+
+	// Revalidate asks the server whether an expired cached copy changed,
+	// using the ETag and Last-Modified stored with it, and reuses the copy
+	// when it did not instead of downloading it again
+	Revalidate bool
+
+	sources map[string]SourceInfo // Source of each URL fetched, by URL
+}
+
+// NewFileCache returns a cache in the user cache directory
+func NewFileCache(ttl time.Duration, refresh bool) (*FileCache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate user cache directory: %w", err)
+	}
+	return &FileCache{Dir: filepath.Join(dir, cacheName), TTL: ttl, Refresh: refresh}, nil
+}
+
+// Source returns the URL, ETag and Last-Modified of the copy of url returned
+// by Fetch or Stream, or false when url was not fetched
+func (c *FileCache) Source(url string) (SourceInfo, bool) {
+	source, ok := c.sources[url]
+	return source, ok
+}
+
+func (c *FileCache) record(source SourceInfo) {
+	if c.sources == nil {
+		c.sources = make(map[string]SourceInfo)
+	}
+	c.sources[source.URL] = source
+}
+
+// recordCached records the source stored with the cached copy of url
+func (c *FileCache) recordCached(url, cachePath string) {
+	source, _ := readSource(cachePath)
+	source.URL = url
+	c.record(source)
+}
+
+// conditional returns the stored source of an expired cached copy to
+// revalidate with the server, or an empty one to download unconditionally
+func (c *FileCache) conditional(cachePath string, validate func(string) error) SourceInfo {
+	if !c.Revalidate || c.Refresh {
+		return SourceInfo{}
+	}
+	if validate != nil && validate(cachePath) != nil {
+		return SourceInfo{}
+	}
+	source, _ := readSource(cachePath)
+	return source
+}
+
+// reuseUnchanged keeps the cached copy of url the server reported as
+// unchanged, restarting its TTL
+func (c *FileCache) reuseUnchanged(url, cachePath string) error {
+	now := time.Now()
+	if err := os.Chtimes(cachePath, now, now); err != nil {
+		return fmt.Errorf("failed to refresh cached file: %w", err)
+	}
+	logf("♻️  %s is unchanged, reusing cached %s\n", url, cachePath)
+	c.recordCached(url, cachePath)
+	return nil
+}
+
+// sourcePath returns the file recording the source of a cached copy
+func sourcePath(cachePath string) string {
+	return strings.TrimSuffix(cachePath, ".json") + ".source.json"
+}
+
+// readSource reads the source stored with a cached copy
+func readSource(cachePath string) (SourceInfo, bool) {
+	var source SourceInfo
+	data, err := os.ReadFile(sourcePath(cachePath))
+	if err != nil || json.Unmarshal(data, &source) != nil {
+		return SourceInfo{}, false
+	}
+	return source, true
+}
+
+// writeSource stores the source of a cached copy next to it
+func writeSource(cachePath string, source SourceInfo) error {
+	data, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(sourcePath(cachePath), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cache source: %w", err)
+	}
+	return nil
+}
+
+// Fetch returns a local copy of url. A fresh cached copy that passes
+// validation is reused, otherwise the file is downloaded and validated. When
+// caching is enabled the download is stored in the cache under name, else it
+// is left in the download directory with a unique name
+func (c *FileCache) Fetch(ctx context.Context, dl *Downloader, url, name, expectedSHA256 string, validate func(string) error) (string, error) {
+	pattern := strings.TrimSuffix(name, ".json") + "-*.json"
+	if c.TTL <= 0 {
+		path, source, err := dl.downloadFile(ctx, url, pattern, expectedSHA256, SourceInfo{})
+		if err != nil {
+			return "", err
+		}
+		c.record(source)
+		return path, validateDownload(path, validate)
+	}
+
+	cachePath := filepath.Join(c.Dir, name)
+	var cond SourceInfo
+	if info, err := os.Stat(cachePath); err == nil && !c.Refresh {
+		age := time.Since(info.ModTime())
+		if age < c.TTL {
+			if validate == nil || validate(cachePath) == nil {
+				logf("♻️  Using cached %s (%s old)\n", cachePath, age.Round(time.Second))
+				c.recordCached(url, cachePath)
+				return cachePath, nil
+			}
+			warnf("⚠️  Cached %s failed validation, downloading a fresh copy\n", cachePath)
+		} else {
+			cond = c.conditional(cachePath, validate)
+		}
+	}
+
+	// Download next to the cached file so the final rename is atomic
+	cacheDl := *dl
+	cacheDl.Dir = c.Dir
+	path, source, err := cacheDl.downloadFile(ctx, url, pattern, expectedSHA256, cond)
+	if notModified(err) {
+		return cachePath, c.reuseUnchanged(url, cachePath)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := validateDownload(path, validate); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path, cachePath); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("failed to store download in cache: %w", err)
+	}
+	c.record(source)
+	return cachePath, writeSource(cachePath, source)
+}
+
+// Stream passes the content of url to process as it is downloaded, instead
+// of storing the whole file before reading it back. A fresh cached copy that
+// passes validation is used instead when available. When caching is enabled
+// the body is also written to the cache; the cached copy is kept only when
+// process succeeds, the checksum matches and it passes validation. It
+// returns the path of the cached copy, or "" when nothing was cached
+func (c *FileCache) Stream(ctx context.Context, dl *Downloader, url, name, expectedSHA256 string, validate func(string) error, process func(io.Reader) error) (string, error) {
+	cachePath := filepath.Join(c.Dir, name)
+	processCached := func() (string, error) {
+		file, err := OpenJSONFile(cachePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to open cached file: %w", err)
+		}
+		defer file.Close()
+		return cachePath, process(file)
+	}
+
+	var cond SourceInfo
+	if c.TTL > 0 && !c.Refresh {
+		if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < c.TTL {
+			if validate == nil || validate(cachePath) == nil {
+				logf("♻️  Using cached %s (%s old)\n", cachePath, time.Since(info.ModTime()).Round(time.Second))
+				c.recordCached(url, cachePath)
+				return processCached()
+			}
+			warnf("⚠️  Cached %s failed validation, downloading a fresh copy\n", cachePath)
+		} else if err == nil {
+			cond = c.conditional(cachePath, validate)
+		}
+	}
+
+	if dl.Offline {
+		return "", &DownloadError{URL: url, Err: errors.New("offline mode")}
+	}
+
+	// Only the request is retried, a failure while processing is final
+	var body io.ReadCloser
+	var size int64
+	var source SourceInfo
+	err := dl.retry(ctx, "Streaming", url, func() error {
+		var err error
+		body, size, source, err = dl.open(ctx, url, cond)
+		return err
+	})
+	if notModified(err) {
+		if err := c.reuseUnchanged(url, cachePath); err != nil {
+			return "", err
+		}
+		return processCached()
+	}
+	if err != nil && ctx.Err() == nil {
+		return "", &DownloadError{URL: url, Err: err}
+	}
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	writers := []io.Writer{hash}
+	var out *os.File
+	if c.TTL > 0 {
+		if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+			return "", fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		if err := dl.checkSpace(c.Dir, size); err != nil {
+			return "", err
+		}
+		out, err = os.CreateTemp(c.Dir, strings.TrimSuffix(name, ".json")+"-*.json")
+		if err != nil {
+			return "", fmt.Errorf("failed to create temp file: %w", err)
+		}
+		defer os.Remove(out.Name())
+		defer out.Close()
+		writers = append(writers, out)
+	}
+
+	// The download progress stands in for the scan progress of process
+	progress := newProgressReader(body, size)
+	reader := io.TeeReader(progress, io.MultiWriter(writers...))
+	streamingDownload.Store(true)
+	err = process(reader)
+	streamingDownload.Store(false)
+	switch {
+	case err == nil:
+	case progress.err != nil && ctx.Err() == nil:
+		// The connection failed mid-body, not the JSON
+		return "", &DownloadError{URL: url, Err: progress.err}
+	case malformedJSON(err):
+		return "", &ValidationError{Err: fmt.Errorf("downloaded file is invalid: %w", err)}
+	default:
+		return "", err
+	}
+
+	// Read whatever process left unread so the checksum and cache cover the
+	// whole file
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return "", fmt.Errorf("error reading from response: %w", err)
+	}
+	progress.done()
+	if err := verifyChecksum(hash, expectedSHA256); err != nil {
+		return "", err
+	}
+
+	c.record(source)
+	if out == nil {
+		return "", nil
+	}
+	if err := out.Close(); err != nil {
+		return "", fmt.Errorf("failed to write cache file: %w", err)
+	}
+	if err := validateDownload(out.Name(), validate); err != nil {
+		return "", err
+	}
+	if err := os.Rename(out.Name(), cachePath); err != nil {
+		return "", fmt.Errorf("failed to store download in cache: %w", err)
+	}
+	return cachePath, writeSource(cachePath, source)
+}
+
+// malformedJSON reports whether err comes from decoding invalid or truncated
+// JSON
+func malformedJSON(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// CleanDownloads removes downloaded pool and token files and cached
+// balances from dirs and returns how many files were removed and their total
+// size
+func CleanDownloads(dirs ...string) (int, int64, error) {
+	var removed int
+	var reclaimed int64
+	for _, dir := range dirs {
+		for _, pattern := range []string{"raydium-pools*.json", "raydium-tokens*.json", "raydium-balances*.json"} {
+			matches, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return removed, reclaimed, fmt.Errorf("invalid clean pattern: %w", err)
+			}
+
+			for _, path := range matches {
+				info, err := os.Stat(path)
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				if err := os.Remove(path); err != nil {
+					return removed, reclaimed, fmt.Errorf("failed to remove %s: %w", path, err)
+				}
+				logf("🗑️  Removed %s\n", path)
+				removed++
+				reclaimed += info.Size()
+			}
+		}
+	}
+	return removed, reclaimed, nil
+}
+
+// validateDownload validates a freshly downloaded file, removing it when it
+// is invalid
+func validateDownload(path string, validate func(string) error) error {
+	if validate == nil {
+		return nil
+	}
+	if err := validate(path); err != nil {
+		os.Remove(path)
+		return &ValidationError{Err: fmt.Errorf("downloaded file is invalid: %w", err)}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package pooltrim
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCacheStreamValidates(t *testing.T) {
+	const body = `{"official":[],"unOfficial":[{"id":"a"}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		validate func(string) error
+		wantErr  bool
+	}{
+		{name: "valid", validate: func(string) error { return nil }},
+		{name: "invalid", validate: func(string) error { return errors.New("missing pools") }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dl := &Downloader{Client: server.Client(), Dir: dir, SkipSpaceCheck: true}
+			cache := &FileCache{Dir: dir, TTL: time.Hour}
+
+			var processed []byte
+			path, err := cache.Stream(context.Background(), dl, server.URL, PoolsCacheFile, "", tt.validate, func(r io.Reader) error {
+				var err error
+				processed, err = io.ReadAll(r)
+				return err
+			})
+			if string(processed) != body {
+				t.Errorf("processed %q, want %q", processed, body)
+			}
+
+			var validation *ValidationError
+			if tt.wantErr {
+				if !errors.As(err, &validation) {
+					t.Fatalf("Stream() error = %v, want a *ValidationError", err)
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("cache dir holds %d files after a failed validation, want none", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Stream() error = %v", err)
+			}
+			if want := filepath.Join(dir, PoolsCacheFile); path != want {
+				t.Errorf("Stream() = %q, want %q", path, want)
+			}
+			if data, err := os.ReadFile(path); err != nil || string(data) != body {
+				t.Errorf("cached copy = %q, %v, want %q", data, err, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package pooltrim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// poolFieldNames are the JSON names of the RaydiumPool fields, in order
+var poolFieldNames = func() []string {
+	t := reflect.TypeOf(RaydiumPool{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}()
+
+// ParsePoolFields splits a comma-separated list of pool field names, as
+// they appear in the JSON output, rejecting names a pool does not have
+func ParsePoolFields(list string) ([]string, error) {
+	var fields []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(poolFieldNames, name) {
+			return nil, fmt.Errorf("unknown pool field %q, expected one of %s", name, strings.Join(poolFieldNames, ", "))
+		}
+		if !slices.Contains(fields, name) {
+			fields = append(fields, name)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no pool fields given, expected some of %s", strings.Join(poolFieldNames, ", "))
+	}
+	return fields, nil
+}
+
+// poolValues returns the encoded value of each field of the pool by JSON
+// name. Unset optional fields such as reserves are absent
+func poolValues(pool RaydiumPool) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(pool)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// projectedPool encodes a pool as a JSON object holding only fields, in
+// order, or every field including Extra when fields is nil. A non-empty
+// symbol is prepended as a "symbol" field, or under symbolKey when set
+type projectedPool struct {
+	symbol    string
+	symbolKey string
+	pool      RaydiumPool
+	fields    []string
+}
+
+func (p projectedPool) MarshalJSON() ([]byte, error) {
+	values, err := poolValues(p.pool)
+	if err != nil {
+		return nil, err
+	}
+	fields := p.fields
+	if fields == nil {
+		fields = append(slices.Clip(poolFieldNames), sortedKeys(p.pool.Extra)...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	if p.symbol != "" {
+		symbol, err := json.Marshal(p.symbol)
+		if err != nil {
+			return nil, err
+		}
+		key := p.symbolKey
+		if key == "" {
+			key = "symbol"
+		}
+		fmt.Fprintf(&buf, "%q:", key)
+		buf.Write(symbol)
+	}
+	for _, name := range fields {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", name)
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// projectedEntry and projectedList mirror TokenPoolInfo and
+// TokenPoolInfoList with their pools reduced to the requested fields
+type projectedEntry struct {
+	Token TokenInfo       `json:"token"`
+	Quote *TokenInfo      `json:"quote,omitempty"`
+	File  string          `json:"file,omitempty"`
+	Pools []projectedPool `json:"pools"`
+}
+
+type projectedList struct {
+	OutputMetadata
+	Tokens []any `json:"tokens"` // TokenPoolInfo or projectedEntry
+}
+
+// projectEntry returns the entry with its pools reduced to fields, or the
+// entry itself when fields is nil
+func projectEntry(entry TokenPoolInfo, fields []string) any {
+	if fields == nil {
+		return entry
+	}
+	return toProjectedEntry(entry, fields)
+}
+
+func toProjectedEntry(entry TokenPoolInfo, fields []string) projectedEntry {
+	projected := projectedEntry{Token: entry.Token, Quote: entry.Quote, File: entry.File, Pools: []projectedPool{}}
+	for _, pool := range entry.Pools {
+		projected.Pools = append(projected.Pools, projectedPool{pool: pool, fields: fields})
+	}
+	return projected
+}
+
+// projectList returns the token list with the pools of the entries at the
+// fresh indexes reduced to fields, leaving the other entries as stored, or
+// the list itself when fields is nil
+func projectList(tokenList TokenPoolInfoList, fields []string, fresh map[int]bool) any {
+	if fields == nil {
+		return tokenList
+	}
+	projected := projectedList{OutputMetadata: tokenList.OutputMetadata, Tokens: []any{}}
+	for i, entry := range tokenList.Tokens {
+		if fresh[i] {
+			projected.Tokens = append(projected.Tokens, toProjectedEntry(entry, fields))
+		} else {
+			projected.Tokens = append(projected.Tokens, entry)
+		}
+	}
+	return projected
+}
+
+// csvValue formats an encoded pool field for CSV, unquoting strings and
+// leaving absent values empty
+func csvValue(value json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		return text
+	}
+	if value == nil || string(value) == "null" {
+		return ""
+	}
+	return string(value)
+}
@@ -0,0 +1,36 @@
+package pooltrim
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePoolFields(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "id", want: []string{"id"}},
+		{list: "id,baseVault,quoteVault", want: []string{"id", "baseVault", "quoteVault"}},
+		{list: " id , baseMint ", want: []string{"id", "baseMint"}},
+		{list: "id,,baseMint,", want: []string{"id", "baseMint"}},
+		{list: "id,baseMint,id", want: []string{"id", "baseMint"}},
+		{list: "baseReserve,price", want: []string{"baseReserve", "price"}},
+		{list: "", wantErr: true},
+		{list: " , ", wantErr: true},
+		{list: "ID", wantErr: true},
+		{list: "id,lpVault", wantErr: true},
+		{list: "Extra", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePoolFields(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePoolFields(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParsePoolFields(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
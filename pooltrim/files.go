@@ -0,0 +1,110 @@
+package pooltrim
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileExists checks if a file exists
+func FileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// readCloser pairs a reader with the function that releases it
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// StdinPath is the input path that selects stdin
+const StdinPath = "-"
+
+// OpenJSONFile opens a JSON file for reading, or stdin for StdinPath,
+// transparently decompressing gzip data detected by its magic header
+func OpenJSONFile(path string) (io.ReadCloser, error) {
+	var file io.ReadCloser = io.NopCloser(os.Stdin)
+	if path != StdinPath {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return readCloser{Reader: reader, close: file.Close}, nil
+	}
+
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read gzip header: %w", err)
+	}
+	return readCloser{Reader: gz, close: func() error {
+		gz.Close()
+		return file.Close()
+	}}, nil
+}
+
+// BackupFile copies the file at path to path.bak, replacing an older backup,
+// and returns the backup path
+func BackupFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file to back up: %w", err)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file to back up: %w", err)
+	}
+
+	backupPath := path + ".bak"
+	dst, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	return backupPath, nil
+}
+
+// contextReader fails reads with ctx's error once ctx is done, so long
+// decodes can be aborted
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,254 @@
+package pooltrim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "warn"
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// LogOutput receives progress and informational messages. It discards them
+// by default; the CLI points it at the terminal
+var LogOutput io.Writer = io.Discard
+
+// LogLevel is the minimum level of the messages written to LogOutput
+var LogLevel = LevelInfo
+
+// jsonLogger receives the messages instead of LogOutput once JSON logs are enabled
+var jsonLogger *slog.Logger
+
+// EnableJSONLogs writes log messages to w as one JSON object per line
+// instead of writing them to LogOutput
+func EnableJSONLogs(w io.Writer) {
+	jsonLogger = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// slogLevels maps levels to their slog equivalents
+var slogLevels = map[Level]slog.Level{
+	LevelDebug: slog.LevelDebug,
+	LevelInfo:  slog.LevelInfo,
+	LevelWarn:  slog.LevelWarn,
+	LevelError: slog.LevelError,
+}
+
+// Logf writes a message to LogOutput when its level is enabled
+func Logf(level Level, format string, args ...any) {
+	if level < LogLevel {
+		return
+	}
+	if jsonLogger == nil {
+		// Keep an in-place progress update on its own line
+		inPlace := strings.HasPrefix(format, "\r")
+		if progressShown && !inPlace {
+			fmt.Fprintln(LogOutput)
+		}
+		progressShown = inPlace && !strings.HasSuffix(format, "\n")
+		fmt.Fprintf(LogOutput, format, args...)
+		return
+	}
+
+	// In-place progress updates have no trailing newline and are dropped
+	message := fmt.Sprintf(format, args...)
+	if !strings.HasSuffix(message, "\n") {
+		return
+	}
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(line[strings.LastIndex(line, "\r")+1:])
+		line = strings.TrimLeftFunc(line, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if line != "" {
+			jsonLogger.Log(context.Background(), slogLevels[level], line)
+		}
+	}
+}
+
+// ProgressStyle controls how progress updates are shown
+type ProgressStyle int
+
+const (
+	// ProgressBar redraws a single line in place, for terminals
+	ProgressBar ProgressStyle = iota
+	// ProgressPlain prints a periodic newline-terminated line, for log files
+	ProgressPlain
+	// ProgressNone hides progress updates, keeping only the final summaries
+	ProgressNone
+)
+
+var progressStyleNames = []string{"bar", "plain", "none"}
+
+func (p ProgressStyle) String() string {
+	if p < ProgressBar || p > ProgressNone {
+		return fmt.Sprintf("progress(%d)", int(p))
+	}
+	return progressStyleNames[p]
+}
+
+// ParseProgressStyle parses a progress style name such as "plain"
+func ParseProgressStyle(name string) (ProgressStyle, error) {
+	for i, styleName := range progressStyleNames {
+		if strings.EqualFold(name, styleName) {
+			return ProgressStyle(i), nil
+		}
+	}
+	return ProgressBar, fmt.Errorf("unknown progress style %q, expected one of %s", name, strings.Join(progressStyleNames, ", "))
+}
+
+// Progress is the style of the progress updates written to LogOutput
+var Progress = ProgressBar
+
+// plainProgressInterval is the minimum time between two plain progress lines
+const plainProgressInterval = 5 * time.Second
+
+// progressShown is set while an in-place progress update ends the last line
+// written to LogOutput
+var progressShown bool
+
+// lastPlainProgress is when the last plain progress line was printed
+var lastPlainProgress time.Time
+
+// progressf shows a progress update in the configured style
+func progressf(format string, args ...any) {
+	switch Progress {
+	case ProgressNone:
+		return
+	case ProgressPlain:
+		if time.Since(lastPlainProgress) < plainProgressInterval {
+			return
+		}
+		lastPlainProgress = time.Now()
+		logf("%s\n", strings.TrimRight(fmt.Sprintf(format, args...), " "))
+	default:
+		logf("\r"+format, args...)
+	}
+}
+
+// progressDonef prints the final message of a series of progress updates,
+// replacing the last in-place update in bar style
+func progressDonef(format string, args ...any) {
+	lastPlainProgress = time.Time{}
+	message := fmt.Sprintf(format, args...)
+	if Progress == ProgressBar {
+		logf("\r%s", message)
+		return
+	}
+	logf("%s\n", strings.TrimRight(strings.TrimSuffix(message, "\n"), " "))
+}
+
+// logf prints an informational message to the log output
+func logf(format string, args ...any) {
+	Logf(LevelInfo, format, args...)
+}
+
+// debugf prints a debug message to the log output
+func debugf(format string, args ...any) {
+	Logf(LevelDebug, format, args...)
+}
+
+// warnf prints a warning to the log output
+func warnf(format string, args ...any) {
+	Logf(LevelWarn, format, args...)
+}
+
+// scanLog writes the messages of one pool scan. A buffered scanLog keeps
+// them until the scan ends, so scans running at the same time do not
+// interleave, and drops progress updates
+type scanLog struct {
+	buffered bool
+	mu       sync.Mutex
+	messages []scanMessage
+}
+
+type scanMessage struct {
+	level Level
+	text  string
+}
+
+func (l *scanLog) printf(level Level, format string, args ...any) {
+	if !l.buffered {
+		Logf(level, format, args...)
+		return
+	}
+	if level < LogLevel {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, scanMessage{level: level, text: fmt.Sprintf(format, args...)})
+}
+
+func (l *scanLog) logf(format string, args ...any) {
+	l.printf(LevelInfo, format, args...)
+}
+
+func (l *scanLog) debugf(format string, args ...any) {
+	l.printf(LevelDebug, format, args...)
+}
+
+func (l *scanLog) warnf(format string, args ...any) {
+	l.printf(LevelWarn, format, args...)
+}
+
+func (l *scanLog) progressf(format string, args ...any) {
+	if !l.buffered {
+		progressf(format, args...)
+	}
+}
+
+func (l *scanLog) progressDonef(format string, args ...any) {
+	if !l.buffered {
+		progressDonef(format, args...)
+		return
+	}
+	l.logf("%s\n", strings.TrimRight(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), " "))
+}
+
+// flush writes the buffered messages with each line prefixed by prefix
+func (l *scanLog) flush(prefix string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, message := range l.messages {
+		var text strings.Builder
+		for _, line := range strings.SplitAfter(message.text, "\n") {
+			if strings.TrimSpace(line) != "" {
+				text.WriteString(prefix)
+			}
+			text.WriteString(line)
+		}
+		Logf(message.level, "%s", text.String())
+	}
+	l.messages = nil
+}
@@ -0,0 +1,971 @@
+package pooltrim
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// StdoutPath is the output path that selects stdout
+const StdoutPath = "-"
+
+// WriteOptions controls how output files are written. The zero value
+// writes indented JSON with every pool field, merged into an existing file
+type WriteOptions struct {
+	// Compact writes JSON on a single line instead of indented with two
+	// spaces
+	Compact bool
+
+	// Fields restricts the pool fields written to JSON, NDJSON and CSV
+	// output to these JSON names, in this order. Entries already stored in
+	// a JSON output file keep every field. Nil writes every field
+	Fields []string
+
+	// AppendOnly keeps existing output entries untouched, so only new
+	// token/quote pairs are added
+	AppendOnly bool
+
+	// Overwrite ignores any existing output file, so the file only holds
+	// the entries being written
+	Overwrite bool
+
+	// RecoverCorrupt moves an existing output file that cannot be parsed
+	// aside to <output>.corrupt and starts a fresh file, instead of failing
+	// the write
+	RecoverCorrupt bool
+
+	// Metadata replaces the metadata recorded in the JSON output file. Nil
+	// keeps the metadata already stored
+	Metadata *OutputMetadata
+}
+
+// ErrTokenNotStored is returned by QueryToken when the output file has no
+// entry for the symbol
+var ErrTokenNotStored = errors.New("token not stored")
+
+// CorruptOutputError reports an existing output file that cannot be parsed
+type CorruptOutputError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptOutputError) Error() string {
+	return fmt.Sprintf("failed to parse existing output file %s: %v", e.Path, e.Err)
+}
+
+func (e *CorruptOutputError) Unwrap() error {
+	return e.Err
+}
+
+// output is an output destination. Data only replaces the destination once
+// Commit succeeds; closing without committing discards it
+type output interface {
+	io.WriteCloser
+	Commit() error
+}
+
+// createOutput opens the output destination, where StdoutPath selects stdout
+func createOutput(outputPath string) (output, error) {
+	if outputPath == StdoutPath {
+		return stdoutOutput{os.Stdout}, nil
+	}
+
+	// Write next to the target so the final rename is atomic
+	file, err := os.CreateTemp(filepath.Dir(outputPath), filepath.Base(outputPath)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	return &atomicFile{File: file, path: outputPath}, nil
+}
+
+// WriteFileAtomic writes data to path through a temp file in the same
+// directory, so readers never see a partially written file
+func WriteFileAtomic(path string, data []byte) error {
+	out, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := out.Write(data); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return out.Commit()
+}
+
+// stdoutOutput wraps a writer that must not be closed, such as stdout
+type stdoutOutput struct {
+	io.Writer
+}
+
+func (stdoutOutput) Commit() error { return nil }
+func (stdoutOutput) Close() error  { return nil }
+
+// atomicFile is a temp file that replaces the file at path on Commit, so an
+// interrupted or failed write never leaves a truncated output behind
+type atomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+// Commit renames the temp file over the target, keeping the target's
+// permissions when it exists
+func (f *atomicFile) Commit() error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(f.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := f.File.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set output file permissions: %w", err)
+	}
+	if err := f.File.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := os.Rename(f.File.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace output file: %w", err)
+	}
+	f.committed = true
+	return nil
+}
+
+// Close discards the temp file unless it was committed
+func (f *atomicFile) Close() error {
+	if f.committed {
+		return nil
+	}
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+// SortFields lists the fields SortPools can sort by
+var SortFields = []string{"version", "baseDecimals", "liquidity", "price"}
+
+// sortKey returns the value of a sort field for a pool, or nil when the pool
+// has no value for it
+func sortKey(pool RaydiumPool, field, baseMint string) *float64 {
+	var value float64
+	switch field {
+	case "version":
+		value = float64(pool.Version)
+	case "baseDecimals":
+		value = float64(pool.BaseDecimals)
+	case "liquidity":
+		_, quote := pool.reserves(baseMint)
+		return quote
+	case "price":
+		return pool.Price
+	}
+	return &value
+}
+
+// SortPools sorts the pools of every token by field, one of SortFields,
+// keeping file order between equal pools. Pools without a value for the
+// field, such as pools without reserves when sorting by liquidity, go last
+func SortPools(poolsByMint map[string][]RaydiumPool, field string, desc bool) error {
+	if !slices.Contains(SortFields, field) {
+		return fmt.Errorf("unsupported sort field %q", field)
+	}
+
+	for mint, pools := range poolsByMint {
+		slices.SortStableFunc(pools, func(a, b RaydiumPool) int {
+			ka, kb := sortKey(a, field, mint), sortKey(b, field, mint)
+			switch {
+			case ka == nil && kb == nil:
+				return 0
+			case ka == nil:
+				return 1
+			case kb == nil:
+				return -1
+			case desc:
+				return cmp.Compare(*kb, *ka)
+			default:
+				return cmp.Compare(*ka, *kb)
+			}
+		})
+	}
+	return nil
+}
+
+// LimitPools truncates the pools of every token to the first n and returns
+// how many pools were dropped
+func LimitPools(poolsByMint map[string][]RaydiumPool, n int) int {
+	dropped := 0
+	for mint, pools := range poolsByMint {
+		if len(pools) > n {
+			dropped += len(pools) - n
+			poolsByMint[mint] = pools[:n]
+		}
+	}
+	return dropped
+}
+
+// RankedPool is a pool of a base token in a ranking across tokens
+type RankedPool struct {
+	Mint      string // Base token mint the pool is stored under
+	Quote     string // Mint on the other side of the pool
+	Pool      RaydiumPool
+	Liquidity *float64 // Quote reserve, nil when unknown
+}
+
+// TopPools keeps only the n pools with the deepest quote reserve across all
+// tokens, removing the rest from poolsByMint, and returns them from deepest
+// to shallowest. Reserves of different quote tokens are not comparable, so
+// all pools are expected to share one quote token. Pools without reserves
+// rank last
+func TopPools(poolsByMint map[string][]RaydiumPool, n int) []RankedPool {
+	var all []RankedPool
+	for mint, pools := range poolsByMint {
+		for _, pool := range pools {
+			quote := pool.QuoteMint
+			if quote == mint {
+				quote = pool.BaseMint
+			}
+			all = append(all, RankedPool{Mint: mint, Quote: quote, Pool: pool, Liquidity: sortKey(pool, "liquidity", mint)})
+		}
+	}
+
+	// Map order is random, so ties are broken by mint and pool ID
+	slices.SortStableFunc(all, func(a, b RankedPool) int {
+		ka, kb := a.Liquidity, b.Liquidity
+		switch {
+		case ka != nil && kb != nil && *ka != *kb:
+			return cmp.Compare(*kb, *ka)
+		case ka != nil && kb == nil:
+			return -1
+		case ka == nil && kb != nil:
+			return 1
+		}
+		return cmp.Or(cmp.Compare(a.Mint, b.Mint), cmp.Compare(a.Pool.ID, b.Pool.ID))
+	})
+	ranked := all[:min(n, len(all))]
+
+	for mint := range poolsByMint {
+		poolsByMint[mint] = nil
+	}
+	for _, r := range ranked {
+		poolsByMint[r.Mint] = append(poolsByMint[r.Mint], r.Pool)
+	}
+	return ranked
+}
+
+// EntryChange describes how merging the filtered pools changes the output
+// entry of one token
+type EntryChange struct {
+	Token         *TokenInfo
+	Quote         *TokenInfo
+	Pools         int
+	PreviousPools int
+	Update        bool // The token/quote pair already had an entry
+	Skip          bool // The existing entry was kept because of AppendOnly
+
+	index int // Position of the entry in the merged list
+}
+
+// ReadOutputFile reads an output file written by WriteFilteredPools, also
+// accepting the legacy format holding a single TokenPoolInfo
+func ReadOutputFile(outputPath string) (TokenPoolInfoList, error) {
+	var tokenList TokenPoolInfoList
+
+	existingFile, err := os.ReadFile(outputPath)
+	if err != nil {
+		return tokenList, fmt.Errorf("failed to read existing output file: %w", err)
+	}
+
+	// A legacy file decodes without error but has no tokens key
+	err = json.Unmarshal(existingFile, &tokenList)
+	if err == nil && tokenList.Tokens != nil {
+		return tokenList, nil
+	}
+
+	// If the file exists but isn't in the new format, try to read it as a
+	// single TokenPoolInfo. Anything else, such as a token list that failed
+	// to decode, is corrupt rather than an empty legacy entry
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(existingFile, &keys) != nil || keys["token"] == nil {
+		if err == nil {
+			err = errors.New("neither a tokens list nor a legacy token entry")
+		}
+		return tokenList, &CorruptOutputError{Path: outputPath, Err: err}
+	}
+	var oldFormat TokenPoolInfo
+	if err := json.Unmarshal(existingFile, &oldFormat); err != nil {
+		return tokenList, &CorruptOutputError{Path: outputPath, Err: err}
+	}
+	// Convert old format to new format
+	tokenList.Tokens = []TokenPoolInfo{oldFormat}
+	return tokenList, nil
+}
+
+// writeOutputFile encodes v, a token list or its projection, to the output
+// destination
+func writeOutputFile(outputPath string, v any, opts WriteOptions) error {
+	file, err := createOutput(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	if !opts.Compact {
+		encoder.SetIndent("", "  ")
+	}
+
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return file.Commit()
+}
+
+// QueryToken returns the entries for symbol, ignoring case, stored in the
+// output file
+func QueryToken(outputPath, symbol string) ([]TokenPoolInfo, error) {
+	tokenList, err := ReadOutputFile(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	symbol = strings.TrimPrefix(symbol, "$")
+	var entries []TokenPoolInfo
+	for _, entry := range tokenList.Tokens {
+		if strings.EqualFold(entry.Token.Symbol, symbol) {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no entry for %s in %s", ErrTokenNotStored, symbol, outputPath)
+	}
+	return entries, nil
+}
+
+// RemoveToken drops every entry for symbol, ignoring case, from the output
+// file and returns how many entries were removed. The file is only rewritten
+// when something was removed
+func RemoveToken(outputPath, symbol string, opts WriteOptions) (int, error) {
+	tokenList, err := ReadOutputFile(outputPath)
+	if err != nil {
+		return 0, err
+	}
+
+	symbol = strings.TrimPrefix(symbol, "$")
+	kept := tokenList.Tokens[:0]
+	for _, entry := range tokenList.Tokens {
+		if !strings.EqualFold(entry.Token.Symbol, symbol) {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(tokenList.Tokens) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	tokenList.Tokens = kept
+	if err := writeOutputFile(outputPath, tokenList, opts); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// PoolEntries returns the entry of each token paired with quote
+func PoolEntries(tokens []*TokenInfo, quote *TokenInfo, poolsByMint map[string][]RaydiumPool) []TokenPoolInfo {
+	entries := make([]TokenPoolInfo, 0, len(tokens))
+	for _, tokenInfo := range tokens {
+		entries = append(entries, TokenPoolInfo{Token: *tokenInfo, Quote: quote, Pools: poolsByMint[tokenInfo.Mint]})
+	}
+	return entries
+}
+
+// QuoteEntries groups the pools of each token by the mint on the other side
+// of the pool, returning one entry per token/quote pair in the order the
+// pairs first appear. Counter tokens are described by their entry in
+// knownTokens, which may be nil, when listed there. Tokens without pools get
+// no entry
+func QuoteEntries(tokens []*TokenInfo, poolsByMint map[string][]RaydiumPool, knownTokens *TokenMap) []TokenPoolInfo {
+	var entries []TokenPoolInfo
+	for _, tokenInfo := range tokens {
+		index := make(map[string]int)
+		for _, pool := range poolsByMint[tokenInfo.Mint] {
+			counterMint := pool.QuoteMint
+			if pool.QuoteMint == tokenInfo.Mint {
+				counterMint = pool.BaseMint
+			}
+			i, ok := index[counterMint]
+			if !ok {
+				i = len(entries)
+				index[counterMint] = i
+				quote := QuoteTokenInfo(counterMint)
+				if known, ok := knownTokens.Mint(counterMint); ok {
+					quote = &known
+				}
+				entries = append(entries, TokenPoolInfo{Token: *tokenInfo, Quote: quote})
+			}
+			entries[i].Pools = append(entries[i].Pools, pool)
+		}
+	}
+	return entries
+}
+
+// MergeConflict is an entry of a merged file whose token/quote pair is
+// already stored with a different token mint
+type MergeConflict struct {
+	Symbol       string
+	Quote        string
+	Mint         string // Mint of the entry being merged
+	ExistingMint string // Mint of the entry already in the output file
+}
+
+// MergeResult summarizes a MergeOutputFile call
+type MergeResult struct {
+	Added     int
+	Updated   int
+	Conflicts []MergeConflict
+}
+
+// MergeOutputFile upserts the entries of another output file into the output
+// file, matching entries by symbol, mint, quote and file like
+// WriteFilteredPools. Pools of matching entries are combined, dropping
+// repeated pool IDs. Entries whose symbol is only stored with another mint
+// are reported as conflicts and left out. A missing output file is created
+func MergeOutputFile(outputPath, otherPath string, opts WriteOptions) (MergeResult, error) {
+	var result MergeResult
+	other, err := ReadOutputFile(otherPath)
+	if err != nil {
+		return result, err
+	}
+
+	var tokenList TokenPoolInfoList
+	if FileExists(outputPath) {
+		if tokenList, err = ReadOutputFile(outputPath); err != nil {
+			return result, err
+		}
+	}
+	// The merged file describes whichever of the two was generated last
+	if other.newer(tokenList.OutputMetadata) {
+		tokenList.OutputMetadata = other.OutputMetadata
+	}
+
+	for _, entry := range other.Tokens {
+		// An entry with the same mint is matched even when another entry
+		// stores the symbol with a different mint first
+		var existing, conflict *TokenPoolInfo
+		for i, stored := range tokenList.Tokens {
+			if stored.Token.Symbol != entry.Token.Symbol || stored.QuoteMint() != entry.QuoteMint() || stored.File != entry.File {
+				continue
+			}
+			if stored.Token.Mint == entry.Token.Mint {
+				existing = &tokenList.Tokens[i]
+				break
+			}
+			if conflict == nil {
+				conflict = &tokenList.Tokens[i]
+			}
+		}
+
+		switch {
+		case existing == nil && conflict == nil:
+			tokenList.Tokens = append(tokenList.Tokens, entry)
+			result.Added++
+			continue
+		case existing == nil:
+			quote := QuoteTokenInfo(entry.QuoteMint())
+			if entry.Quote != nil {
+				quote = entry.Quote
+			}
+			result.Conflicts = append(result.Conflicts, MergeConflict{
+				Symbol:       entry.Token.Symbol,
+				Quote:        quote.Symbol,
+				Mint:         entry.Token.Mint,
+				ExistingMint: conflict.Token.Mint,
+			})
+			continue
+		}
+
+		seen := make(map[string]bool, len(existing.Pools))
+		for _, pool := range existing.Pools {
+			seen[pool.ID] = true
+		}
+		for _, pool := range entry.Pools {
+			if !seen[pool.ID] {
+				seen[pool.ID] = true
+				existing.Pools = append(existing.Pools, pool)
+			}
+		}
+		result.Updated++
+	}
+
+	if result.Added+result.Updated == 0 {
+		return result, nil
+	}
+	return result, writeOutputFile(outputPath, tokenList, opts)
+}
+
+// mergeFilteredPools reads the existing output file and upserts each entry,
+// returning the merged list and the change made for each entry. Writing to
+// stdout or with Overwrite skips the merge with an existing file
+func mergeFilteredPools(outputPath string, entries []TokenPoolInfo, opts WriteOptions) (TokenPoolInfoList, []EntryChange, error) {
+	var tokenList TokenPoolInfoList
+	var changes []EntryChange
+
+	// Try to read existing file
+	if outputPath != StdoutPath && !opts.Overwrite && FileExists(outputPath) {
+		var err error
+		var corrupt *CorruptOutputError
+		tokenList, err = ReadOutputFile(outputPath)
+		switch {
+		case err != nil && opts.RecoverCorrupt && errors.As(err, &corrupt):
+			warnf("⚠️  Corrupt output file would be moved to %s.corrupt and replaced by a fresh one: %v\n", outputPath, corrupt.Err)
+			tokenList = TokenPoolInfoList{}
+		case err != nil:
+			return tokenList, nil, err
+		}
+	}
+
+	if opts.Metadata != nil {
+		tokenList.OutputMetadata = *opts.Metadata
+	}
+	for _, entry := range entries {
+		change := EntryChange{Token: &entry.Token, Quote: entry.Quote, Pools: len(entry.Pools)}
+
+		// Check if token/quote pair already exists and update it. Entries are
+		// matched by mint too, so a token reusing another token's symbol never
+		// replaces it
+		var conflict *TokenPoolInfo
+		for i, existing := range tokenList.Tokens {
+			if existing.Token.Symbol != entry.Token.Symbol || existing.QuoteMint() != entry.QuoteMint() || existing.File != entry.File {
+				continue
+			}
+			if existing.Token.Mint != entry.Token.Mint {
+				conflict = &tokenList.Tokens[i]
+				continue
+			}
+			change.PreviousPools = len(existing.Pools)
+			if opts.AppendOnly {
+				change.Skip = true
+				break
+			}
+			change.Update = true
+			change.index = i
+			tokenList.Tokens[i] = entry
+			break
+		}
+
+		// If token wasn't found, append it
+		if !change.Update && !change.Skip {
+			if conflict != nil {
+				warnf("⚠️  %s/%s is already stored for mint %s, keeping it and adding a separate entry for mint %s\n",
+					entry.Token.Symbol, entry.Quote.Symbol, conflict.Token.Mint, entry.Token.Mint)
+			}
+			change.index = len(tokenList.Tokens)
+			tokenList.Tokens = append(tokenList.Tokens, entry)
+		}
+		changes = append(changes, change)
+	}
+	return tokenList, changes, nil
+}
+
+// PreviewFilteredPools prints what WriteFilteredPools would add to or update
+// in the output file without writing it
+func PreviewFilteredPools(outputPath string, tokens []*TokenInfo, quote *TokenInfo, poolsByMint map[string][]RaydiumPool, opts WriteOptions) error {
+	return PreviewPoolEntries(outputPath, PoolEntries(tokens, quote, poolsByMint), opts)
+}
+
+// PreviewPoolEntries prints what WritePoolEntries would add to or update in
+// the output file without writing it
+func PreviewPoolEntries(outputPath string, entries []TokenPoolInfo, opts WriteOptions) error {
+	tokenList, changes, err := mergeFilteredPools(outputPath, entries, opts)
+	if err != nil {
+		return err
+	}
+
+	logf("\n📝 Dry run, %s is left untouched:\n", outputPath)
+	for _, change := range changes {
+		switch {
+		case change.Skip:
+			logf("  keep %s/%s: %d pools\n", change.Token.Symbol, change.Quote.Symbol, change.PreviousPools)
+		case change.Update:
+			logf("  update %s/%s: %d -> %d pools\n", change.Token.Symbol, change.Quote.Symbol, change.PreviousPools, change.Pools)
+		default:
+			logf("  insert %s/%s: %d pools\n", change.Token.Symbol, change.Quote.Symbol, change.Pools)
+		}
+	}
+	logf("📊 File would contain information for %d tokens\n", len(tokenList.Tokens))
+	return nil
+}
+
+// WriteFilteredPools writes or appends the filtered pools to the output file,
+// upserting an entry for each token. Writing to stdout skips the merge with
+// an existing file
+func WriteFilteredPools(outputPath string, tokens []*TokenInfo, quote *TokenInfo, poolsByMint map[string][]RaydiumPool, opts WriteOptions) error {
+	return WritePoolEntries(outputPath, PoolEntries(tokens, quote, poolsByMint), opts)
+}
+
+// WritePoolEntries writes or appends entries to the output file, upserting
+// each token/quote pair. Writing to stdout skips the merge with an existing
+// file
+func WritePoolEntries(outputPath string, entries []TokenPoolInfo, opts WriteOptions) error {
+	if opts.RecoverCorrupt && !opts.Overwrite {
+		if err := moveCorruptOutput(outputPath); err != nil {
+			return err
+		}
+	}
+
+	tokenList, changes, err := mergeFilteredPools(outputPath, entries, opts)
+	if err != nil {
+		return err
+	}
+
+	written, totalPools := 0, 0
+	fresh := make(map[int]bool)
+	for _, change := range changes {
+		if change.Skip {
+			logf("⏭️  Skipping existing entry for %s/%s, keeping it untouched\n", change.Token.Symbol, change.Quote.Symbol)
+			continue
+		}
+		if change.Update {
+			logf("🔄 Updating existing entry for %s/%s in the output file...\n", change.Token.Symbol, change.Quote.Symbol)
+		}
+		fresh[change.index] = true
+		written++
+		totalPools += change.Pools
+	}
+
+	// Write back to file. Only the entries of this run are reduced to
+	// Fields, so stored entries keep every field
+	if err := writeOutputFile(outputPath, projectList(tokenList, opts.Fields, fresh), opts); err != nil {
+		return err
+	}
+
+	logf("✅ Successfully wrote/updated info for %d tokens and %d pools to %s\n", written, totalPools, outputPath)
+	logf("📊 File now contains information for %d tokens\n", len(tokenList.Tokens))
+	return nil
+}
+
+// moveCorruptOutput renames an existing output file that cannot be parsed to
+// <output>.corrupt, so the next write starts a fresh file
+func moveCorruptOutput(outputPath string) error {
+	if outputPath == StdoutPath || !FileExists(outputPath) {
+		return nil
+	}
+	var corrupt *CorruptOutputError
+	if _, err := ReadOutputFile(outputPath); !errors.As(err, &corrupt) {
+		return nil
+	}
+
+	corruptPath := outputPath + ".corrupt"
+	if err := os.Rename(outputPath, corruptPath); err != nil {
+		return fmt.Errorf("failed to move corrupt output file aside: %w", err)
+	}
+	warnf("⚠️  Moved corrupt output file to %s and starting a fresh one: %v\n", corruptPath, corrupt.Err)
+	return nil
+}
+
+// SplitFileName returns the base file name of an entry written by
+// WriteSplitEntries: the sanitized token symbol, followed by the quote symbol
+// for pairs that are not quoted in SOL. Symbols with nothing usable left are
+// replaced by their mint
+func SplitFileName(entry TokenPoolInfo) string {
+	name := symbolOrMint(entry.Token)
+	if entry.QuoteMint() != DefaultQuoteMint {
+		name += "-" + symbolOrMint(*entry.Quote)
+	}
+	return name + ".json"
+}
+
+// symbolOrMint returns the sanitized symbol of a token, or its mint when the
+// symbol has no safe characters
+func symbolOrMint(token TokenInfo) string {
+	if symbol := SanitizeSymbol(token.Symbol); symbol != "" {
+		return symbol
+	}
+	return SanitizeSymbol(token.Mint)
+}
+
+// splitMintChars is how many characters of the token mint tell apart split
+// files whose names would collide
+const splitMintChars = 8
+
+// splitFileNames returns the file name of each entry. Entries sharing a
+// SplitFileName, such as two mints with the same symbol or symbols that
+// sanitize alike, get the start of their token mint appended. Names that
+// still collide are an error rather than one file replacing the other
+func splitFileNames(entries []TokenPoolInfo) ([]string, error) {
+	names := make([]string, len(entries))
+	uses := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		names[i] = SplitFileName(entry)
+		uses[names[i]]++
+	}
+
+	owners := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		if uses[names[i]] > 1 {
+			mint := SanitizeSymbol(entry.Token.Mint)
+			names[i] = strings.TrimSuffix(names[i], ".json") + "-" + mint[:min(splitMintChars, len(mint))] + ".json"
+		}
+		if j, ok := owners[names[i]]; ok {
+			return nil, fmt.Errorf("entries %s (%s) and %s (%s) would both be written to %s",
+				entries[j].Token.Symbol, entries[j].Token.Mint, entry.Token.Symbol, entry.Token.Mint, names[i])
+		}
+		owners[names[i]] = i
+	}
+	return names, nil
+}
+
+// marshalJSON encodes v indented, or on a single line when compact
+func marshalJSON(v any, compact bool) ([]byte, error) {
+	if compact {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// WriteSplitEntries writes each entry to its own file in dir, named by
+// SplitFileName and replacing any previous file. Colliding names are told
+// apart by the token mint
+func WriteSplitEntries(dir string, entries []TokenPoolInfo, opts WriteOptions) error {
+	names, err := splitFileNames(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create split output directory: %w", err)
+	}
+
+	for i, entry := range entries {
+		data, err := marshalJSON(projectEntry(entry, opts.Fields), opts.Compact)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", entry.Token.Symbol, err)
+		}
+		path := filepath.Join(dir, names[i])
+		if err := WriteFileAtomic(path, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	logf("✅ Wrote %d per-token files to %s\n", len(entries), dir)
+	return nil
+}
+
+// WriteFilteredPoolsCSV writes the filtered pools as CSV, prepending a token
+// symbol column when more than one token was requested
+func WriteFilteredPoolsCSV(outputPath string, tokens []*TokenInfo, poolsByMint map[string][]RaydiumPool, opts WriteOptions) error {
+	file, err := createOutput(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	withSymbol := len(tokens) > 1
+	header := []string{"id", "baseMint", "quoteMint", "lpMint", "programId", "marketId", "version", "baseDecimals", "quoteDecimals", "lpDecimals"}
+	if withSymbol {
+		header = append([]string{"symbol"}, header...)
+	}
+
+	// Reserve and price columns are only added when they were fetched
+	withReserves, withPrice := false, false
+	for _, pools := range poolsByMint {
+		for _, pool := range pools {
+			withReserves = withReserves || pool.BaseReserve != nil || pool.QuoteReserve != nil
+			withPrice = withPrice || pool.Price != nil
+		}
+	}
+	if withReserves {
+		header = append(header, "baseReserve", "quoteReserve")
+	}
+	if withPrice {
+		header = append(header, "price")
+	}
+
+	// With Fields the columns are exactly the requested fields
+	if opts.Fields != nil {
+		header = slices.Clone(opts.Fields)
+		if withSymbol {
+			header = append([]string{"symbol"}, header...)
+		}
+	}
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write(header); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	totalPools := 0
+	for _, tokenInfo := range tokens {
+		for _, pool := range poolsByMint[tokenInfo.Mint] {
+			var record []string
+			if opts.Fields != nil {
+				values, err := poolValues(pool)
+				if err != nil {
+					return fmt.Errorf("failed to encode pool %s: %w", pool.ID, err)
+				}
+				for _, name := range opts.Fields {
+					record = append(record, csvValue(values[name]))
+				}
+			} else {
+				record = []string{
+					pool.ID,
+					pool.BaseMint,
+					pool.QuoteMint,
+					pool.LPMint,
+					pool.ProgramID,
+					pool.MarketID,
+					strconv.Itoa(pool.Version),
+					strconv.Itoa(pool.BaseDecimals),
+					strconv.Itoa(pool.QuoteDecimals),
+					strconv.Itoa(pool.LPDecimals),
+				}
+				if withReserves {
+					record = append(record, formatAmount(pool.BaseReserve), formatAmount(pool.QuoteReserve))
+				}
+				if withPrice {
+					record = append(record, formatAmount(pool.Price))
+				}
+			}
+			if withSymbol {
+				record = append([]string{tokenInfo.Symbol}, record...)
+			}
+			if err := writer.Write(record); err != nil {
+				return fmt.Errorf("failed to write CSV record: %w", err)
+			}
+			totalPools++
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := file.Commit(); err != nil {
+		return err
+	}
+
+	logf("✅ Successfully wrote %d pools for %d tokens to %s\n", totalPools, len(tokens), outputPath)
+	return nil
+}
+
+// WriteFilteredPoolsNDJSON writes the filtered pools as newline-delimited
+// JSON, one pool object per line
+func WriteFilteredPoolsNDJSON(outputPath string, tokens []*TokenInfo, poolsByMint map[string][]RaydiumPool, opts WriteOptions) error {
+	file, err := createOutput(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	withSymbol := len(tokens) > 1
+	encoder := json.NewEncoder(file)
+	totalPools := 0
+	for _, tokenInfo := range tokens {
+		for _, pool := range poolsByMint[tokenInfo.Mint] {
+			// The token symbol is prepended when more than one token was requested
+			line := projectedPool{pool: pool, fields: opts.Fields}
+			if withSymbol {
+				line.symbol = tokenInfo.Symbol
+			}
+			if err := encoder.Encode(line); err != nil {
+				return fmt.Errorf("failed to write output file: %w", err)
+			}
+			totalPools++
+		}
+	}
+	if err := file.Commit(); err != nil {
+		return err
+	}
+
+	logf("✅ Successfully wrote %d pools for %d tokens to %s\n", totalPools, len(tokens), outputPath)
+	return nil
+}
+
+// WriteRankedPools writes the pools of a TopPools ranking as a single JSON
+// array in rank order, each starting with a "tokenSymbol" field naming its
+// token. Like WriteFilteredPoolsFlat it replaces the output file and never
+// replaces a token list
+func WriteRankedPools(outputPath string, ranked []RankedPool, tokens []*TokenInfo, opts WriteOptions) error {
+	symbols := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		symbols[token.Mint] = token.Symbol
+	}
+	flat := []projectedPool{}
+	for _, r := range ranked {
+		flat = append(flat, projectedPool{symbol: symbols[r.Mint], symbolKey: "tokenSymbol", pool: r.Pool, fields: opts.Fields})
+	}
+	return writeFlatPools(outputPath, flat, len(tokens), opts)
+}
+
+// WriteFilteredPoolsFlat writes the filtered pools as a single JSON array of
+// pools instead of a token list, for consumers expecting plain pools. With
+// withSymbol each pool starts with a "tokenSymbol" field. The output file is
+// replaced rather than merged, and a token list output file is never
+// replaced
+func WriteFilteredPoolsFlat(outputPath string, tokens []*TokenInfo, poolsByMint map[string][]RaydiumPool, withSymbol bool, opts WriteOptions) error {
+	flat := []projectedPool{}
+	for _, tokenInfo := range tokens {
+		for _, pool := range poolsByMint[tokenInfo.Mint] {
+			entry := projectedPool{pool: pool, fields: opts.Fields}
+			if withSymbol {
+				entry.symbol, entry.symbolKey = tokenInfo.Symbol, "tokenSymbol"
+			}
+			flat = append(flat, entry)
+		}
+	}
+	return writeFlatPools(outputPath, flat, len(tokens), opts)
+}
+
+// writeFlatPools encodes pools of tokens tokens as a JSON array to the
+// output destination
+func writeFlatPools(outputPath string, flat []projectedPool, tokens int, opts WriteOptions) error {
+	if isTokenListFile(outputPath) {
+		return fmt.Errorf("%s holds a token list, refusing to replace it with a flat pool list", outputPath)
+	}
+	file, err := createOutput(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	if !opts.Compact {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(flat); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := file.Commit(); err != nil {
+		return err
+	}
+
+	logf("✅ Successfully wrote %d pools for %d tokens to %s\n", len(flat), tokens, outputPath)
+	return nil
+}
+
+// isTokenListFile reports whether the file at path is a JSON object, such as
+// a token list written by WritePoolEntries, rather than a flat pool array
+func isTokenListFile(path string) bool {
+	if path == StdoutPath {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	token, err := json.NewDecoder(file).Token()
+	return err == nil && token == json.Delim('{')
+}
+
+// formatAmount formats an optional reserve or price for CSV, leaving unknown
+// amounts empty
+func formatAmount(amount *float64) string {
+	if amount == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*amount, 'f', -1, 64)
+}
@@ -0,0 +1,491 @@
+package pooltrim
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func reserve(amount float64) *float64 {
+	return &amount
+}
+
+// poolIDs returns the IDs of pools in order
+func poolIDs(pools []RaydiumPool) []string {
+	ids := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		ids = append(ids, pool.ID)
+	}
+	return ids
+}
+
+func TestSortPools(t *testing.T) {
+	pools := func() map[string][]RaydiumPool {
+		return map[string][]RaydiumPool{testBonkMint: {
+			{ID: "a", Version: 4, BaseDecimals: 5, BaseMint: testBonkMint, QuoteReserve: reserve(10)},
+			{ID: "b", Version: 5, BaseDecimals: 5, BaseMint: testBonkMint},
+			{ID: "c", Version: 4, BaseDecimals: 9, QuoteMint: testBonkMint, BaseReserve: reserve(30), QuoteReserve: reserve(1)},
+			{ID: "d", Version: 5, BaseDecimals: 6, BaseMint: testBonkMint, QuoteReserve: reserve(20), Price: reserve(2)},
+		}}
+	}
+
+	tests := []struct {
+		field   string
+		desc    bool
+		want    []string
+		wantErr bool
+	}{
+		{field: "version", want: []string{"a", "c", "b", "d"}},
+		{field: "version", desc: true, want: []string{"b", "d", "a", "c"}},
+		{field: "baseDecimals", want: []string{"a", "b", "d", "c"}},
+		// The reserve of the mint's side counts, whatever the pool's orientation
+		{field: "liquidity", desc: true, want: []string{"c", "d", "a", "b"}},
+		{field: "liquidity", want: []string{"a", "d", "c", "b"}},
+		{field: "price", want: []string{"d", "a", "b", "c"}},
+		{field: "tvl", wantErr: true},
+	}
+	for _, tt := range tests {
+		poolsByMint := pools()
+		err := SortPools(poolsByMint, tt.field, tt.desc)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SortPools(%s, %v) error = %v, want error %v", tt.field, tt.desc, err, tt.wantErr)
+			continue
+		}
+		if got := poolIDs(poolsByMint[testBonkMint]); !tt.wantErr && !slices.Equal(got, tt.want) {
+			t.Errorf("SortPools(%s, %v) = %v, want %v", tt.field, tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestTopPools(t *testing.T) {
+	pools := func() map[string][]RaydiumPool {
+		return map[string][]RaydiumPool{
+			testBonkMint: {
+				{ID: "bonk-sol", BaseMint: testBonkMint, QuoteMint: DefaultQuoteMint, QuoteReserve: reserve(50)},
+				{ID: "sol-bonk", BaseMint: DefaultQuoteMint, QuoteMint: testBonkMint, BaseReserve: reserve(80)},
+				{ID: "bonk-sol-empty", BaseMint: testBonkMint, QuoteMint: DefaultQuoteMint},
+			},
+			testWifMint: {
+				{ID: "wif-sol", BaseMint: testWifMint, QuoteMint: DefaultQuoteMint, QuoteReserve: reserve(60)},
+				{ID: "wif-sol-deep", BaseMint: testWifMint, QuoteMint: DefaultQuoteMint, QuoteReserve: reserve(5000)},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		n        int
+		want     []string
+		wantBonk []string
+		wantWif  []string
+	}{
+		{
+			name:    "single pool",
+			n:       1,
+			want:    []string{"wif-sol-deep"},
+			wantWif: []string{"wif-sol-deep"},
+		},
+		{
+			name:     "ranked across tokens",
+			n:        3,
+			want:     []string{"wif-sol-deep", "sol-bonk", "wif-sol"},
+			wantBonk: []string{"sol-bonk"},
+			wantWif:  []string{"wif-sol-deep", "wif-sol"},
+		},
+		{
+			name:     "pools without reserves last",
+			n:        10,
+			want:     []string{"wif-sol-deep", "sol-bonk", "wif-sol", "bonk-sol", "bonk-sol-empty"},
+			wantBonk: []string{"sol-bonk", "bonk-sol", "bonk-sol-empty"},
+			wantWif:  []string{"wif-sol-deep", "wif-sol"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			poolsByMint := pools()
+			ranked := TopPools(poolsByMint, tt.n)
+			var got []string
+			for _, r := range ranked {
+				got = append(got, r.Pool.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("TopPools() = %v, want %v", got, tt.want)
+			}
+			if got := poolIDs(poolsByMint[testBonkMint]); !slices.Equal(got, tt.wantBonk) {
+				t.Errorf("kept BONK pools = %v, want %v", got, tt.wantBonk)
+			}
+			if got := poolIDs(poolsByMint[testWifMint]); !slices.Equal(got, tt.wantWif) {
+				t.Errorf("kept WIF pools = %v, want %v", got, tt.wantWif)
+			}
+		})
+	}
+}
+
+func TestReadOutputFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantSymbols []string
+		wantCorrupt bool
+	}{
+		{
+			name:        "token list",
+			content:     `{"tokens":[{"token":{"symbol":"BONK","mint":"` + testBonkMint + `"},"pools":[{"id":"a"}]},{"token":{"symbol":"WIF","mint":"` + testWifMint + `"},"pools":[]}]}`,
+			wantSymbols: []string{"BONK", "WIF"},
+		},
+		{
+			name:        "empty token list",
+			content:     `{"tokens":[]}`,
+			wantSymbols: []string{},
+		},
+		{
+			name:        "legacy single token",
+			content:     `{"token":{"symbol":"BONK","mint":"` + testBonkMint + `"},"pools":[{"id":"a"}]}`,
+			wantSymbols: []string{"BONK"},
+		},
+		{name: "unrelated object", content: `{"foo":1}`, wantCorrupt: true},
+		{name: "flat pool list", content: `[{"id":"a"}]`, wantCorrupt: true},
+		{name: "truncated", content: `{"tokens":[{"token":`, wantCorrupt: true},
+		{name: "mistyped tokens", content: `{"tokens":{}}`, wantCorrupt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			tokenList, err := ReadOutputFile(path)
+			var corrupt *CorruptOutputError
+			if tt.wantCorrupt {
+				if !errors.As(err, &corrupt) || corrupt.Path != path {
+					t.Fatalf("ReadOutputFile() error = %v, want a *CorruptOutputError for %s", err, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadOutputFile() error = %v", err)
+			}
+			symbols := []string{}
+			for _, entry := range tokenList.Tokens {
+				symbols = append(symbols, entry.Token.Symbol)
+			}
+			if !slices.Equal(symbols, tt.wantSymbols) {
+				t.Errorf("ReadOutputFile() symbols = %v, want %v", symbols, tt.wantSymbols)
+			}
+		})
+	}
+
+	if _, err := ReadOutputFile(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadOutputFile() of a missing file error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestWritePoolEntriesMerge(t *testing.T) {
+	bonk := TokenInfo{Symbol: "BONK", Mint: testBonkMint}
+	otherBonk := TokenInfo{Symbol: "BONK", Mint: "BonkImpostor1111111111111111111111111111111"}
+	wif := TokenInfo{Symbol: "WIF", Mint: testWifMint}
+	sol := QuoteTokenInfo(DefaultQuoteMint)
+	usdc := QuoteTokenInfo(testUSDCMint)
+
+	existing := `{"tokens":[` +
+		`{"token":{"symbol":"BONK","mint":"` + testBonkMint + `"},"pools":[{"id":"old","lpVault":"kept"}]},` +
+		`{"token":{"symbol":"WIF","mint":"` + testWifMint + `"},"pools":[{"id":"wif"}]}]}`
+	legacy := `{"token":{"symbol":"BONK","mint":"` + testBonkMint + `"},"pools":[{"id":"old"}]}`
+
+	type stored struct {
+		symbol, mint, quote string
+		pools               []string
+	}
+	tests := []struct {
+		name     string
+		existing string
+		entries  []TokenPoolInfo
+		opts     WriteOptions
+		want     []stored
+	}{
+		{
+			name:    "new file",
+			entries: []TokenPoolInfo{{Token: bonk, Quote: sol, Pools: []RaydiumPool{{ID: "new"}}}},
+			want:    []stored{{"BONK", testBonkMint, DefaultQuoteMint, []string{"new"}}},
+		},
+		{
+			name:     "replaces the same pair and keeps the others",
+			existing: existing,
+			entries:  []TokenPoolInfo{{Token: bonk, Quote: sol, Pools: []RaydiumPool{{ID: "new"}}}},
+			want: []stored{
+				{"BONK", testBonkMint, DefaultQuoteMint, []string{"new"}},
+				{"WIF", testWifMint, DefaultQuoteMint, []string{"wif"}},
+			},
+		},
+		{
+			name:     "adds another quote",
+			existing: existing,
+			entries:  []TokenPoolInfo{{Token: bonk, Quote: usdc, Pools: []RaydiumPool{{ID: "usdc"}}}},
+			want: []stored{
+				{"BONK", testBonkMint, DefaultQuoteMint, []string{"old"}},
+				{"WIF", testWifMint, DefaultQuoteMint, []string{"wif"}},
+				{"BONK", testBonkMint, testUSDCMint, []string{"usdc"}},
+			},
+		},
+		{
+			name:     "never replaces another mint with the same symbol",
+			existing: existing,
+			entries:  []TokenPoolInfo{{Token: otherBonk, Quote: sol, Pools: []RaydiumPool{{ID: "impostor"}}}},
+			want: []stored{
+				{"BONK", testBonkMint, DefaultQuoteMint, []string{"old"}},
+				{"WIF", testWifMint, DefaultQuoteMint, []string{"wif"}},
+				{"BONK", otherBonk.Mint, DefaultQuoteMint, []string{"impostor"}},
+			},
+		},
+		{
+			name:     "append only keeps existing entries",
+			existing: existing,
+			entries: []TokenPoolInfo{
+				{Token: bonk, Quote: sol, Pools: []RaydiumPool{{ID: "new"}}},
+				{Token: wif, Quote: usdc, Pools: []RaydiumPool{{ID: "wif-usdc"}}},
+			},
+			opts: WriteOptions{AppendOnly: true},
+			want: []stored{
+				{"BONK", testBonkMint, DefaultQuoteMint, []string{"old"}},
+				{"WIF", testWifMint, DefaultQuoteMint, []string{"wif"}},
+				{"WIF", testWifMint, testUSDCMint, []string{"wif-usdc"}},
+			},
+		},
+		{
+			name:     "overwrite drops existing entries",
+			existing: existing,
+			entries:  []TokenPoolInfo{{Token: wif, Quote: sol, Pools: []RaydiumPool{{ID: "new"}}}},
+			opts:     WriteOptions{Overwrite: true},
+			want:     []stored{{"WIF", testWifMint, DefaultQuoteMint, []string{"new"}}},
+		},
+		{
+			name:     "upgrades a legacy file",
+			existing: legacy,
+			entries:  []TokenPoolInfo{{Token: wif, Quote: sol, Pools: []RaydiumPool{{ID: "wif"}}}},
+			want: []stored{
+				{"BONK", testBonkMint, DefaultQuoteMint, []string{"old"}},
+				{"WIF", testWifMint, DefaultQuoteMint, []string{"wif"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.json")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := WritePoolEntries(path, tt.entries, tt.opts); err != nil {
+				t.Fatalf("WritePoolEntries() error = %v", err)
+			}
+
+			tokenList, err := ReadOutputFile(path)
+			if err != nil {
+				t.Fatalf("ReadOutputFile() error = %v", err)
+			}
+			var got []stored
+			for _, entry := range tokenList.Tokens {
+				got = append(got, stored{entry.Token.Symbol, entry.Token.Mint, entry.QuoteMint(), poolIDs(entry.Pools)})
+			}
+			if !slices.EqualFunc(got, tt.want, func(a, b stored) bool {
+				return a.symbol == b.symbol && a.mint == b.mint && a.quote == b.quote && slices.Equal(a.pools, b.pools)
+			}) {
+				t.Errorf("stored entries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWritePoolEntriesKeepsStoredFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	existing := `{"tokens":[{"token":{"symbol":"WIF","mint":"` + testWifMint + `"},"pools":[{"id":"wif","lpVault":"kept"}]}]}`
+	if err := os.WriteFile(path, []byte(existing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bonk := TokenInfo{Symbol: "BONK", Mint: testBonkMint}
+	if err := WritePoolEntries(path, []TokenPoolInfo{{Token: bonk, Pools: []RaydiumPool{{ID: "bonk"}}}}, WriteOptions{}); err != nil {
+		t.Fatalf("WritePoolEntries() error = %v", err)
+	}
+
+	tokenList, err := ReadOutputFile(path)
+	if err != nil {
+		t.Fatalf("ReadOutputFile() error = %v", err)
+	}
+	if got := string(tokenList.Tokens[0].Pools[0].Extra["lpVault"]); got != `"kept"` {
+		t.Errorf("lpVault of the stored pool = %s, want \"kept\"", got)
+	}
+}
+
+func TestWritePoolEntriesFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.json")
+	wif := TokenPoolInfo{Token: TokenInfo{Symbol: "WIF", Mint: testWifMint}, Pools: []RaydiumPool{{ID: "wif", BaseMint: testWifMint, Version: 4}}}
+	if err := WritePoolEntries(path, []TokenPoolInfo{wif}, WriteOptions{}); err != nil {
+		t.Fatalf("WritePoolEntries() error = %v", err)
+	}
+	// storedEntries returns the raw JSON of the stored entries
+	storedEntries := func() []json.RawMessage {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var file struct {
+			Tokens []json.RawMessage `json:"tokens"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Fatal(err)
+		}
+		return file.Tokens
+	}
+	before := storedEntries()
+
+	bonk := TokenPoolInfo{Token: TokenInfo{Symbol: "BONK", Mint: testBonkMint}, Pools: []RaydiumPool{{ID: "bonk", BaseMint: testBonkMint, Version: 4}}}
+	if err := WritePoolEntries(path, []TokenPoolInfo{bonk}, WriteOptions{Fields: []string{"id"}}); err != nil {
+		t.Fatalf("WritePoolEntries() error = %v", err)
+	}
+
+	after := storedEntries()
+	if len(after) != 2 {
+		t.Fatalf("got %d stored entries, want 2", len(after))
+	}
+	if !bytes.Equal(compactJSON(t, after[0]), compactJSON(t, before[0])) {
+		t.Errorf("stored entry = %s, want it unchanged as %s", after[0], before[0])
+	}
+	var written struct {
+		Pools []map[string]any `json:"pools"`
+	}
+	if err := json.Unmarshal(after[1], &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written.Pools) != 1 || len(written.Pools[0]) != 1 || written.Pools[0]["id"] != "bonk" {
+		t.Errorf("written pools = %v, want only the id field", written.Pools)
+	}
+}
+
+// compactJSON returns data without insignificant whitespace
+func compactJSON(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWritePoolEntriesCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.json")
+	if err := os.WriteFile(path, []byte(`{"tokens":`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries := []TokenPoolInfo{{Token: TokenInfo{Symbol: "BONK", Mint: testBonkMint}, Pools: []RaydiumPool{{ID: "new"}}}}
+
+	var corrupt *CorruptOutputError
+	if err := WritePoolEntries(path, entries, WriteOptions{}); !errors.As(err, &corrupt) {
+		t.Fatalf("WritePoolEntries() error = %v, want a *CorruptOutputError", err)
+	}
+
+	if err := WritePoolEntries(path, entries, WriteOptions{RecoverCorrupt: true}); err != nil {
+		t.Fatalf("WritePoolEntries() with RecoverCorrupt error = %v", err)
+	}
+	if data, err := os.ReadFile(path + ".corrupt"); err != nil || string(data) != `{"tokens":` {
+		t.Errorf("corrupt file = %q, %v, want the original content", data, err)
+	}
+	if _, err := ReadOutputFile(path); err != nil {
+		t.Errorf("ReadOutputFile() after recovery error = %v", err)
+	}
+}
+
+func TestMergeOutputFile(t *testing.T) {
+	const impostorMint = "BonkImpostor1111111111111111111111111111111"
+	bonk := `{"token":{"symbol":"BONK","mint":"` + testBonkMint + `"},"pools":[{"id":"a"},{"id":"b"}]}`
+	impostor := `{"token":{"symbol":"BONK","mint":"` + impostorMint + `"},"pools":[{"id":"x"}]}`
+	wif := `{"token":{"symbol":"WIF","mint":"` + testWifMint + `"},"pools":[{"id":"w"}]}`
+	tokens := func(entries ...string) string {
+		return `{"tokens":[` + strings.Join(entries, ",") + `]}`
+	}
+
+	tests := []struct {
+		name          string
+		existing      string
+		other         string
+		wantAdded     int
+		wantUpdated   int
+		wantConflicts []MergeConflict
+		wantPools     map[string][]string // Pool IDs by mint
+	}{
+		{
+			name:      "adds new entries",
+			existing:  tokens(bonk),
+			other:     tokens(wif),
+			wantAdded: 1,
+			wantPools: map[string][]string{testBonkMint: {"a", "b"}, testWifMint: {"w"}},
+		},
+		{
+			name:        "combines the pools of the same mint",
+			existing:    tokens(bonk),
+			other:       tokens(`{"token":{"symbol":"BONK","mint":"` + testBonkMint + `"},"pools":[{"id":"b"},{"id":"c"}]}`),
+			wantUpdated: 1,
+			wantPools:   map[string][]string{testBonkMint: {"a", "b", "c"}},
+		},
+		{
+			name:          "reports a symbol stored only with another mint",
+			existing:      tokens(bonk),
+			other:         tokens(impostor),
+			wantConflicts: []MergeConflict{{Symbol: "BONK", Quote: "SOL", Mint: impostorMint, ExistingMint: testBonkMint}},
+			wantPools:     map[string][]string{testBonkMint: {"a", "b"}},
+		},
+		{
+			name:        "matches the same mint after another one",
+			existing:    tokens(impostor, bonk),
+			other:       tokens(`{"token":{"symbol":"BONK","mint":"` + testBonkMint + `"},"pools":[{"id":"c"}]}`),
+			wantUpdated: 1,
+			wantPools:   map[string][]string{impostorMint: {"x"}, testBonkMint: {"a", "b", "c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path, otherPath := filepath.Join(dir, "out.json"), filepath.Join(dir, "other.json")
+			if err := os.WriteFile(path, []byte(tt.existing), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(otherPath, []byte(tt.other), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := MergeOutputFile(path, otherPath, WriteOptions{})
+			if err != nil {
+				t.Fatalf("MergeOutputFile() error = %v", err)
+			}
+			if result.Added != tt.wantAdded || result.Updated != tt.wantUpdated {
+				t.Errorf("added %d and updated %d entries, want %d and %d", result.Added, result.Updated, tt.wantAdded, tt.wantUpdated)
+			}
+			if !slices.Equal(result.Conflicts, tt.wantConflicts) {
+				t.Errorf("Conflicts = %+v, want %+v", result.Conflicts, tt.wantConflicts)
+			}
+
+			tokenList, err := ReadOutputFile(path)
+			if err != nil {
+				t.Fatalf("ReadOutputFile() error = %v", err)
+			}
+			got := make(map[string][]string)
+			for _, entry := range tokenList.Tokens {
+				got[entry.Token.Mint] = poolIDs(entry.Pools)
+			}
+			if len(got) != len(tt.wantPools) {
+				t.Errorf("stored pools = %v, want %v", got, tt.wantPools)
+			}
+			for mint, ids := range tt.wantPools {
+				if !slices.Equal(got[mint], ids) {
+					t.Errorf("pools of %s = %v, want %v", mint, got[mint], ids)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,830 @@
+package pooltrim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PoolFilter holds the optional criteria a token/quote pool must also meet.
+// The zero value keeps every pool
+type PoolFilter struct {
+	Versions         map[int]bool // Allowed pool versions, empty allows all
+	MinVersion       int          // Lowest allowed pool version, 0 allows all
+	MinDecimals      int
+	MaxDecimals      int             // Zero means no upper bound
+	Skip             map[string]bool // Pool sections that are not scanned
+	ProgramIDs       map[string]bool // Allowed AMM programs, empty allows all
+	MarketProgramIDs map[string]bool // Allowed market programs, empty allows all
+	MarketVersions   map[int]bool    // Allowed market versions, empty allows all
+	MarketID         string          // Only keep the pools on this market, empty allows all
+	AnyQuote         bool            // Match base token pools whatever the mint on the other side
+	QuoteMints       map[string]bool // Mints AnyQuote accepts on the other side, empty allows all
+	Workers          int             // Goroutines decoding pools, 0 or 1 decodes serially
+	ProgressInterval int             // Pools between progress updates, 0 disables them
+	MaxUnofficial    int             // Unofficial pools scanned before the section is cut short, 0 scans all
+	CountOnly        bool            // Only count the pools, without decoding or matching them
+
+	// KeepUnknownFields keeps the pool fields RaydiumPool does not know
+	// about in Extra, so they are written to the output unchanged. Without
+	// it the scan drops them
+	KeepUnknownFields bool
+
+	// SkipBadPools logs and skips pools that are valid JSON but cannot be
+	// decoded, instead of failing the whole scan
+	SkipBadPools bool
+
+	// StrictSchema fails the scan with a *ValidationError on a pool with a
+	// field RaydiumPool does not know about, to catch upstream format changes
+	StrictSchema bool
+}
+
+// decodePool decodes a pool of the scanned pool list, dropping the fields
+// RaydiumPool does not know about unless KeepUnknownFields is set, or
+// rejecting them with StrictSchema
+func (f *PoolFilter) decodePool(data []byte, pool *RaydiumPool) error {
+	// Finding the unknown fields decodes the pool a second time, so it is
+	// only done when they are kept or rejected
+	var err error
+	if f.KeepUnknownFields || f.StrictSchema {
+		err = json.Unmarshal(data, pool)
+	} else {
+		err = pool.decodeKnown(data)
+	}
+	if err == nil && f.StrictSchema && len(pool.Extra) > 0 {
+		err = fmt.Errorf("pool %s: unknown fields %s", pool.ID, strings.Join(sortedKeys(pool.Extra), ", "))
+	}
+	if err != nil && f.StrictSchema {
+		return &ValidationError{Err: err}
+	}
+	return err
+}
+
+// decodeStoredPool decodes a pool keeping every field, as stored in the
+// output file
+func decodeStoredPool(data []byte, pool *RaydiumPool) error {
+	return json.Unmarshal(data, pool)
+}
+
+// matchLogLimit is the number of matched pools logged per token before the
+// rest are only counted, unless debug logging is on
+const matchLogLimit = 20
+
+// quoteAllowed reports whether an AnyQuote match may have mint on the other
+// side
+func (f *PoolFilter) quoteAllowed(mint string) bool {
+	return len(f.QuoteMints) == 0 || f.QuoteMints[mint]
+}
+
+// scans reports whether pools in the given section are scanned
+func (f *PoolFilter) scans(section string) bool {
+	return !f.Skip[section]
+}
+
+// reject returns the reason a pool of the given base token is filtered out,
+// or "" to keep it
+func (f *PoolFilter) reject(pool RaydiumPool, baseMint string) string {
+	if len(f.Versions) > 0 && !f.Versions[pool.Version] {
+		return "version"
+	}
+	if pool.Version < f.MinVersion {
+		return "minimum version"
+	}
+	if len(f.ProgramIDs) > 0 && !f.ProgramIDs[pool.ProgramID] {
+		return "program ID"
+	}
+	if len(f.MarketProgramIDs) > 0 && !f.MarketProgramIDs[pool.MarketProgramID] {
+		return "market program ID"
+	}
+	if len(f.MarketVersions) > 0 && !f.MarketVersions[pool.MarketVersion] {
+		return "market version"
+	}
+	if f.MarketID != "" && pool.MarketID != f.MarketID {
+		return "market ID"
+	}
+
+	// The base token may sit on either side of the pool
+	decimals := pool.BaseDecimals
+	if pool.QuoteMint == baseMint {
+		decimals = pool.QuoteDecimals
+	}
+	if decimals < f.MinDecimals || (f.MaxDecimals > 0 && decimals > f.MaxDecimals) {
+		return "decimals"
+	}
+	return ""
+}
+
+// ValidateJSON checks if the downloaded file is a valid and complete JSON
+func ValidateJSON(filePath string) error {
+	return validatePoolList(filePath, true)
+}
+
+// ValidateJSONSyntax checks the file like ValidateJSON without decoding the
+// official pools, only their JSON syntax, for scans that skip undecodable
+// pools
+func ValidateJSONSyntax(filePath string) error {
+	return validatePoolList(filePath, false)
+}
+
+func validatePoolList(filePath string, decodePools bool) error {
+	file, err := OpenJSONFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file for validation: %w", err)
+	}
+	defer file.Close()
+
+	// Create a decoder for validation
+	decoder := json.NewDecoder(file)
+
+	// Try to decode and validate structure
+	var response RaydiumResponse
+	if !decodePools {
+		var raw struct {
+			Name     string            `json:"name"`
+			Official []json.RawMessage `json:"official"`
+		}
+		if err := decoder.Decode(&raw); err != nil {
+			return fmt.Errorf("invalid JSON structure: %w", err)
+		}
+		response.Name = raw.Name
+		if raw.Official != nil {
+			response.Official = make([]RaydiumPool, len(raw.Official))
+		}
+	} else if err := decoder.Decode(&response); err != nil {
+		return fmt.Errorf("invalid JSON structure: %w", err)
+	}
+
+	// Basic validation of the response
+	if response.Name == "" {
+		return fmt.Errorf("invalid JSON: missing name field")
+	}
+	if response.Official == nil {
+		return fmt.Errorf("invalid JSON: missing official pools array")
+	}
+	if len(response.Official) == 0 {
+		return fmt.Errorf("invalid JSON: empty pools array")
+	}
+
+	logf("✅ JSON validation successful: found %d pools\n", len(response.Official))
+	return nil
+}
+
+// CheckPoolFields scans every pool in the file and reports how many lack
+// required fields. It fails when the share of incomplete pools exceeds
+// maxInvalidRatio and warns otherwise. A pool that cannot be decoded fails
+// the check, even for scans that skip such pools
+func CheckPoolFields(filePath string, maxInvalidRatio float64) error {
+	file, err := OpenJSONFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file for validation: %w", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("failed to read opening token: %w", err)
+	}
+
+	var total, invalid int
+	missing := make(map[string]int)
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read field name: %w", err)
+		}
+		if key != SectionOfficial && key != SectionUnofficial {
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return fmt.Errorf("failed to skip %v: %w", key, err)
+			}
+			continue
+		}
+
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("failed to read array start: %w", err)
+		}
+		err = forEachPool(decoder, 1, 0, decodeStoredPool, func(pool RaydiumPool) {
+			total++
+			complete := true
+			for _, field := range []struct{ name, value string }{
+				{"id", pool.ID},
+				{"baseMint", pool.BaseMint},
+				{"quoteMint", pool.QuoteMint},
+				{"baseVault", pool.BaseVault},
+				{"quoteVault", pool.QuoteVault},
+			} {
+				if field.value == "" {
+					missing[field.name]++
+					complete = false
+				}
+			}
+			if !complete {
+				invalid++
+			}
+		}, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("failed to read array end: %w", err)
+		}
+	}
+
+	if invalid == 0 {
+		logf("✅ Strict validation successful: all %d pools are complete\n", total)
+		return nil
+	}
+
+	fields := make([]string, 0, len(missing))
+	for field := range missing {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	warnf("⚠️  %d of %d pools are missing required fields:\n", invalid, total)
+	for _, field := range fields {
+		warnf("  Missing %s: %d\n", field, missing[field])
+	}
+
+	if ratio := float64(invalid) / float64(total); ratio > maxInvalidRatio {
+		return fmt.Errorf("%.2f%% of pools are incomplete, above the %.2f%% threshold", ratio*100, maxInvalidRatio*100)
+	}
+	return nil
+}
+
+// ScanStats summarizes a pass over a pool list
+type ScanStats struct {
+	BytesRead       int64   `json:"bytesRead"` // Decompressed bytes read from the pool list
+	OfficialPools   int     `json:"officialPools"`
+	UnofficialPools int     `json:"unofficialPools"`
+	MatchedPools    int     `json:"matchedPools"`
+	FilteredPools   int     `json:"filteredPools"` // Token/quote pools dropped by the filter
+	DuplicatePools  int     `json:"duplicatePools"`
+	BadPools        int     `json:"badPools"`  // Undecodable pools skipped with PoolFilter.SkipBadPools
+	Truncated       bool    `json:"truncated"` // The unofficial pools were cut short by MaxUnofficial
+	ElapsedSeconds  float64 `json:"elapsedSeconds"`
+	BytesPerSecond  float64 `json:"bytesPerSecond"`
+	PoolsPerSecond  float64 `json:"poolsPerSecond"`
+}
+
+// FilterPools returns the pools in a Raydium pool list that pair baseMint
+// with quoteMint
+func FilterPools(reader io.Reader, baseMint, quoteMint string) ([]RaydiumPool, error) {
+	base := &TokenInfo{Symbol: baseMint, Mint: baseMint}
+	pools, _, err := ProcessPools(context.Background(), reader, []*TokenInfo{base}, QuoteTokenInfo(quoteMint), nil)
+	if err != nil {
+		return nil, err
+	}
+	return pools[baseMint], nil
+}
+
+// ProcessPoolsFile opens a pool list file, which may be gzip-compressed, and
+// filters it with ProcessPools
+func ProcessPoolsFile(ctx context.Context, filePath string, baseTokens []*TokenInfo, quote *TokenInfo, filter *PoolFilter) (map[string][]RaydiumPool, *ScanStats, error) {
+	return processPoolsFile(ctx, filePath, baseTokens, quote, filter, &scanLog{})
+}
+
+func processPoolsFile(ctx context.Context, filePath string, baseTokens []*TokenInfo, quote *TokenInfo, filter *PoolFilter, scan *scanLog) (map[string][]RaydiumPool, *ScanStats, error) {
+	file, err := OpenJSONFile(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	return processPools(ctx, file, baseTokens, quote, filter, scan)
+}
+
+// FileScan holds the matches and statistics of one of several pool files
+type FileScan struct {
+	Path  string
+	Pools map[string][]RaydiumPool
+	Stats *ScanStats
+}
+
+// ProcessPoolFiles validates and filters several pool list files like
+// ProcessPoolsFile, scanning up to workers files at a time. The scans are
+// returned in the order of paths. The first failure cancels the remaining
+// scans. With several paths the messages of each scan are held back and
+// written together once all scans end, each line prefixed with the path
+func ProcessPoolFiles(ctx context.Context, paths []string, workers int, baseTokens []*TokenInfo, quote *TokenInfo, filter *PoolFilter) ([]FileScan, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	scans := make([]FileScan, len(paths))
+	errs := make([]error, len(paths))
+	logs := make([]*scanLog, len(paths))
+	slots := make(chan struct{}, max(workers, 1))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		logs[i] = &scanLog{buffered: len(paths) > 1}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			validate := ValidateJSON
+			if filter != nil && filter.SkipBadPools {
+				validate = ValidateJSONSyntax
+			}
+			if err := validate(path); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", path, err)
+				cancel()
+				return
+			}
+			pools, stats, err := processPoolsFile(ctx, path, baseTokens, quote, filter, logs[i])
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", path, err)
+				cancel()
+				return
+			}
+			scans[i] = FileScan{Path: path, Pools: pools, Stats: stats}
+		}()
+	}
+	wg.Wait()
+	for i, path := range paths {
+		logs[i].flush(path + ": ")
+	}
+
+	// Report the failure that caused the cancellation rather than the
+	// cancellations it caused
+	var first error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return nil, first
+	}
+	return scans, nil
+}
+
+// ProcessPools streams a Raydium pool list from reader and filters pools for
+// all base tokens in a single pass, returning the matches keyed by base mint
+// and statistics about the scan.
+// The reader may be a file, an HTTP response body or an in-memory buffer. A
+// nil filter keeps every token/quote pool, and a filter with AnyQuote keeps
+// every pool of the base tokens, ignoring quote, or only those against
+// QuoteMints when it is set. Without base tokens, a filter
+// with a MarketID matches the pools on that market whatever their mints,
+// keyed by their base mint. A filter with CountOnly only fills the pool
+// counts of the stats. Reading stops with ctx's error once ctx is done
+func ProcessPools(ctx context.Context, reader io.Reader, baseTokens []*TokenInfo, quote *TokenInfo, filter *PoolFilter) (map[string][]RaydiumPool, *ScanStats, error) {
+	return processPools(ctx, reader, baseTokens, quote, filter, &scanLog{})
+}
+
+// processPools is ProcessPools writing its messages to scan
+func processPools(ctx context.Context, reader io.Reader, baseTokens []*TokenInfo, quote *TokenInfo, filter *PoolFilter, scan *scanLog) (map[string][]RaydiumPool, *ScanStats, error) {
+	start := time.Now()
+	if filter == nil {
+		filter = &PoolFilter{}
+	}
+
+	scan.logf("\n🔍 Processing pools...\n")
+	marketOnly := len(baseTokens) == 0 && filter.MarketID != ""
+	if marketOnly {
+		scan.logf("Looking for pools on market %s\n\n", filter.MarketID)
+	}
+	tokensByMint := make(map[string]*TokenInfo, len(baseTokens))
+	for _, token := range baseTokens {
+		tokensByMint[token.Mint] = token
+		if filter.AnyQuote && len(filter.QuoteMints) > 0 {
+			scan.logf("Looking for %s pairs with %d quote tokens:\n", strings.ToUpper(token.Symbol), len(filter.QuoteMints))
+			scan.logf("  Base Token:  %s\n\n", token.Mint)
+			continue
+		}
+		if filter.AnyQuote {
+			scan.logf("Looking for %s pairs with any quote token:\n", strings.ToUpper(token.Symbol))
+			scan.logf("  Base Token:  %s\n\n", token.Mint)
+			continue
+		}
+		scan.logf("Looking for %s/%s pairs with:\n", strings.ToUpper(token.Symbol), quote.Symbol)
+		scan.logf("  Base Token:  %s\n", token.Mint)
+		scan.logf("  Quote Token: %s\n\n", quote.Mint)
+	}
+
+	counter := &countingReader{r: contextReader{ctx, reader}}
+	decoder := json.NewDecoder(counter)
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read opening token: %w", err)
+	}
+
+	matchingPools := make(map[string][]RaydiumPool, len(baseTokens))
+	var currentSection string
+	var officialCount, unofficialCount int
+	filteredCounts := make(map[string]int)
+
+	// Matched pools by ID, so repeated pools can be collapsed
+	type seenPool struct {
+		index    int
+		official bool
+	}
+	seen := make(map[string]seenPool)
+	duplicates := 0
+	badPools := 0
+	truncated := false
+
+	// Matches past matchLogLimit that were not logged, by base token mint
+	unlisted := make(map[string]int)
+
+	// Stop reading once every scanned section has been processed
+	remaining := 0
+	for _, section := range []string{SectionOfficial, SectionUnofficial} {
+		if filter.scans(section) {
+			remaining++
+		}
+	}
+
+	// Helper function to process a pool
+	processPool := func(pool RaydiumPool, isOfficial bool) {
+		// Check if this is a token/quote pair for any of the base tokens
+		var token *TokenInfo
+		pairQuote := quote
+		if marketOnly {
+			if pool.MarketID == filter.MarketID {
+				token = tokensByMint[pool.BaseMint]
+				if token == nil {
+					token = &TokenInfo{Symbol: pool.BaseMint, Mint: pool.BaseMint, Decimals: pool.BaseDecimals}
+					tokensByMint[token.Mint] = token
+					baseTokens = append(baseTokens, token)
+				}
+				pairQuote = QuoteTokenInfo(pool.QuoteMint)
+			}
+		} else if filter.AnyQuote {
+			if token = tokensByMint[pool.BaseMint]; token != nil && filter.quoteAllowed(pool.QuoteMint) {
+				pairQuote = QuoteTokenInfo(pool.QuoteMint)
+			} else if token = tokensByMint[pool.QuoteMint]; token != nil && filter.quoteAllowed(pool.BaseMint) {
+				pairQuote = QuoteTokenInfo(pool.BaseMint)
+			} else {
+				token = nil
+			}
+		} else if pool.QuoteMint == quote.Mint {
+			token = tokensByMint[pool.BaseMint]
+		} else if pool.BaseMint == quote.Mint {
+			token = tokensByMint[pool.QuoteMint]
+		}
+		if token != nil {
+			if reason := filter.reject(pool, token.Mint); reason != "" {
+				filteredCounts[reason]++
+				return
+			}
+
+			// Keep one copy of a repeated pool, preferring the official one
+			if prev, ok := seen[pool.ID]; ok {
+				duplicates++
+				if isOfficial && !prev.official {
+					matchingPools[token.Mint][prev.index] = pool
+					seen[pool.ID] = seenPool{index: prev.index, official: true}
+				}
+				return
+			}
+			seen[pool.ID] = seenPool{index: len(matchingPools[token.Mint]), official: isOfficial}
+
+			// The full details are only logged at debug level, e.g. with --verbose
+			section := map[bool]string{true: "official", false: "unofficial"}[isOfficial]
+			if LogLevel <= LevelDebug {
+				scan.debugf("\n📊 Pool Details (%s):\n", section)
+				scan.debugf("  ID:              %s\n", pool.ID)
+				scan.debugf("  Base Token:      %s\n", pool.BaseMint)
+				scan.debugf("  Quote Token:     %s\n", pool.QuoteMint)
+				scan.debugf("  LP Token:        %s\n", pool.LPMint)
+				scan.debugf("  Program ID:      %s\n", pool.ProgramID)
+				scan.debugf("  Market ID:       %s\n", pool.MarketID)
+				scan.debugf("  Version:         %d\n", pool.Version)
+				scan.debugf("  Market Version:  %d\n", pool.MarketVersion)
+				scan.debugf("  Base Decimals:   %d\n", pool.BaseDecimals)
+				scan.debugf("  Quote Decimals:  %d\n", pool.QuoteDecimals)
+				scan.debugf("  LP Decimals:     %d\n", pool.LPDecimals)
+			}
+			if LogLevel > LevelDebug && len(matchingPools[token.Mint]) >= matchLogLimit {
+				unlisted[token.Mint]++
+			} else {
+				scan.logf("  ✨ %s/%s pool %s (v%d, %s)\n", strings.ToUpper(token.Symbol), pairQuote.Symbol, pool.ID, pool.Version, section)
+			}
+			matchingPools[token.Mint] = append(matchingPools[token.Mint], pool)
+		}
+	}
+
+	// Process the JSON structure
+scan:
+	for remaining > 0 && decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read field name: %w", err)
+		}
+
+		if key, ok := token.(string); ok {
+			switch key {
+			case "name":
+				if _, err := decoder.Token(); err != nil {
+					return nil, nil, fmt.Errorf("failed to skip name value: %w", err)
+				}
+			case SectionOfficial, SectionUnofficial:
+				currentSection = key
+
+				t, err := decoder.Token()
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to read array start: %w", err)
+				}
+				if delim, ok := t.(json.Delim); !ok || delim != '[' {
+					return nil, nil, fmt.Errorf("expected array start, got %v", t)
+				}
+
+				if !filter.scans(key) {
+					scan.logf("⏭️  Skipping %s pools\n", key)
+					for decoder.More() {
+						var raw json.RawMessage
+						if err := decoder.Decode(&raw); err != nil {
+							return nil, nil, fmt.Errorf("failed to skip pool: %w", err)
+						}
+					}
+					if _, err := decoder.Token(); err != nil {
+						return nil, nil, fmt.Errorf("failed to read array end: %w", err)
+					}
+					continue
+				}
+
+				official := currentSection == SectionOfficial
+				label := strings.ToLower(currentSection)
+				count := &unofficialCount
+				if official {
+					count = &officialCount
+				}
+				tick := func() {
+					*count++
+					if filter.ProgressInterval > 0 && *count%filter.ProgressInterval == 0 && !streamingDownload.Load() {
+						scan.progressf("Processed %d %s pools...", *count, label)
+					}
+				}
+				if filter.CountOnly {
+					for decoder.More() {
+						var raw json.RawMessage
+						if err := decoder.Decode(&raw); err != nil {
+							return nil, nil, fmt.Errorf("failed to read pool: %w", err)
+						}
+						tick()
+					}
+				} else {
+					var bad func(error)
+					if filter.SkipBadPools {
+						bad = func(err error) {
+							tick()
+							badPools++
+							if badPools <= maxBadPoolWarnings {
+								scan.warnf("⚠️  Skipping undecodable %s pool #%d: %v\n", label, *count, err)
+							}
+						}
+					}
+					limit := 0
+					if !official {
+						limit = filter.MaxUnofficial
+					}
+					err = forEachPool(decoder, filter.Workers, limit, filter.decodePool, func(pool RaydiumPool) {
+						tick()
+						processPool(pool, official)
+					}, bad)
+					if err != nil {
+						return nil, nil, err
+					}
+				}
+
+				// Past the cap the rest of the section is skipped, or not
+				// read at all when no other section is left
+				cut := decoder.More()
+				truncated = truncated || cut
+				if cut && remaining > 1 {
+					for decoder.More() {
+						var raw json.RawMessage
+						if err := decoder.Decode(&raw); err != nil {
+							return nil, nil, fmt.Errorf("failed to skip pool: %w", err)
+						}
+					}
+				}
+				if !cut || remaining > 1 {
+					t, err = decoder.Token()
+					if err != nil {
+						return nil, nil, fmt.Errorf("failed to read array end: %w", err)
+					}
+					if delim, ok := t.(json.Delim); !ok || delim != ']' {
+						return nil, nil, fmt.Errorf("expected array end, got %v", t)
+					}
+				}
+
+				if filter.ProgressInterval > 0 && *count >= filter.ProgressInterval {
+					scan.progressDonef("Processed %d %s pools\n", *count, label)
+				}
+
+				remaining--
+				if remaining == 0 {
+					break scan
+				}
+			}
+		}
+	}
+
+	scan.logf("\n📈 Pool Summary:\n")
+	for _, section := range []struct {
+		key, label string
+		count      int
+	}{
+		{SectionOfficial, "Total Official Pools:  ", officialCount},
+		{SectionUnofficial, "Total Unofficial Pools:", unofficialCount},
+	} {
+		if filter.scans(section.key) {
+			scan.logf("  %s %d\n", section.label, section.count)
+		} else {
+			scan.logf("  %s not scanned\n", section.label)
+		}
+	}
+	reasons := make([]string, 0, len(filteredCounts))
+	for reason := range filteredCounts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		scan.logf("  Filtered by %s: %d\n", reason, filteredCounts[reason])
+	}
+	if duplicates > 0 {
+		scan.logf("  Duplicate pools collapsed: %d\n", duplicates)
+	}
+	if badPools > 0 {
+		scan.warnf("  Undecodable pools skipped: %d\n", badPools)
+	}
+	if truncated {
+		scan.warnf("  Unofficial pools truncated after %d, later matches may be missing\n", filter.MaxUnofficial)
+	}
+	stats := &ScanStats{
+		BytesRead:       counter.n,
+		OfficialPools:   officialCount,
+		UnofficialPools: unofficialCount,
+		DuplicatePools:  duplicates,
+		BadPools:        badPools,
+		Truncated:       truncated,
+		ElapsedSeconds:  time.Since(start).Seconds(),
+	}
+	for _, token := range baseTokens {
+		switch {
+		case filter.AnyQuote && len(filter.QuoteMints) > 0:
+			scan.logf("  Found %d %s pairs with %d quote tokens\n", len(matchingPools[token.Mint]), strings.ToUpper(token.Symbol), len(filter.QuoteMints))
+		case filter.AnyQuote:
+			scan.logf("  Found %d %s pairs with any quote token\n", len(matchingPools[token.Mint]), strings.ToUpper(token.Symbol))
+		case !marketOnly:
+			scan.logf("  Found %d %s/%s pairs\n", len(matchingPools[token.Mint]), strings.ToUpper(token.Symbol), quote.Symbol)
+		}
+		if n := unlisted[token.Mint]; n > 0 {
+			scan.logf("  %d more %s pools not listed above, use --verbose to list them all\n", n, strings.ToUpper(token.Symbol))
+		}
+		stats.MatchedPools += len(matchingPools[token.Mint])
+	}
+	if marketOnly {
+		scan.logf("  Found %d pools on market %s\n", stats.MatchedPools, filter.MarketID)
+	}
+	for _, count := range filteredCounts {
+		stats.FilteredPools += count
+	}
+	if stats.ElapsedSeconds > 0 {
+		stats.BytesPerSecond = float64(stats.BytesRead) / stats.ElapsedSeconds
+		stats.PoolsPerSecond = float64(officialCount+unofficialCount) / stats.ElapsedSeconds
+	}
+	scan.logf("  Read %.1f MB in %.1fs (%.1f MB/s, %.0f pools/s)\n", float64(stats.BytesRead)/(1024*1024), stats.ElapsedSeconds, stats.BytesPerSecond/(1024*1024), stats.PoolsPerSecond)
+	return matchingPools, stats, nil
+}
+
+// forEachPool decodes the remaining pools of the current array and passes
+// them to fn in their original order. With more than one worker, raw pool
+// objects are split off the array in batches and decoded by a pool of
+// goroutines, while fn still runs on the calling goroutine. Each raw pool is
+// decoded with decode. A positive limit stops after that many pools, leaving
+// the decoder inside the array. When bad is not nil, pools that are valid
+// JSON but fail to decode are passed to it in order instead of failing the
+// scan; malformed JSON still fails it
+func forEachPool(decoder *json.Decoder, workers, limit int, decode func([]byte, *RaydiumPool) error, fn func(RaydiumPool), bad func(error)) error {
+	read := 0
+	more := func() bool {
+		return decoder.More() && (limit <= 0 || read < limit)
+	}
+	if workers <= 1 {
+		for ; more(); read++ {
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return fmt.Errorf("failed to decode pool: %w", err)
+			}
+			var pool RaydiumPool
+			if err := decode(raw, &pool); err != nil {
+				if bad == nil {
+					return fmt.Errorf("failed to decode pool: %w", err)
+				}
+				bad(err)
+				continue
+			}
+			fn(pool)
+		}
+		return nil
+	}
+
+	const batchSize = 1024
+	type batch struct {
+		raws  []json.RawMessage
+		pools []RaydiumPool
+		errs  []error // Decode failure of each pool, only set when skipping bad pools
+		err   error
+		done  chan struct{}
+	}
+
+	jobs := make(chan *batch)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				b.pools = make([]RaydiumPool, len(b.raws))
+				for i, raw := range b.raws {
+					err := decode(raw, &b.pools[i])
+					if err != nil && bad != nil {
+						if b.errs == nil {
+							b.errs = make([]error, len(b.raws))
+						}
+						b.errs[i] = err
+						continue
+					}
+					if err != nil {
+						b.err = fmt.Errorf("failed to decode pool: %w", err)
+						break
+					}
+				}
+				close(b.done)
+			}
+		}()
+	}
+
+	// Batches are queued in read order so results can be consumed in order
+	// while later batches are still being decoded
+	ordered := make(chan *batch, workers)
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+		for more() {
+			b := &batch{done: make(chan struct{})}
+			for ; len(b.raws) < batchSize && more(); read++ {
+				var raw json.RawMessage
+				if err := decoder.Decode(&raw); err != nil {
+					readErr <- fmt.Errorf("failed to decode pool: %w", err)
+					return
+				}
+				b.raws = append(b.raws, raw)
+			}
+			select {
+			case jobs <- b:
+			case <-stop:
+				readErr <- nil
+				return
+			}
+			ordered <- b
+		}
+		readErr <- nil
+	}()
+
+	var err error
+	for b := range ordered {
+		<-b.done
+		if err != nil {
+			continue
+		}
+		if b.err != nil {
+			err = b.err
+			close(stop)
+			continue
+		}
+		for i, pool := range b.pools {
+			if b.errs != nil && b.errs[i] != nil {
+				bad(b.errs[i])
+				continue
+			}
+			fn(pool)
+		}
+	}
+	wg.Wait()
+
+	if readErr := <-readErr; err == nil {
+		err = readErr
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package pooltrim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	testBonkMint = "DezXAZ8z7PnrnRJjz3wXBoRgixCa6xjnB7YaB1pPB263"
+	testWifMint  = "EKpQGSJtjMFqKZ9KQanSqYXRcF8fBopzLHYxdM65zcjm"
+	testUSDCMint = "EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v"
+)
+
+// testPoolList has a BONK/SOL pool in each section, one of them with the
+// mints swapped, a BONK/USDC pool and a WIF/SOL pool
+const testPoolList = `{"name":"Raydium Mainnet Liquidity Pools","official":[
+{"id":"bonk-sol","baseMint":"` + testBonkMint + `","quoteMint":"` + DefaultQuoteMint + `","version":4,"baseDecimals":5,"quoteDecimals":9,"marketId":"market-a"},
+{"id":"bonk-usdc","baseMint":"` + testBonkMint + `","quoteMint":"` + testUSDCMint + `","version":4,"baseDecimals":5,"quoteDecimals":6,"marketId":"market-b"}
+],"unOfficial":[
+{"id":"sol-bonk","baseMint":"` + DefaultQuoteMint + `","quoteMint":"` + testBonkMint + `","version":5,"baseDecimals":9,"quoteDecimals":5,"marketId":"market-c"},
+{"id":"wif-sol","baseMint":"` + testWifMint + `","quoteMint":"` + DefaultQuoteMint + `","version":4,"baseDecimals":6,"quoteDecimals":9,"marketId":"market-d","lpVault":"extra"}
+]}`
+
+func TestProcessPools(t *testing.T) {
+	bonk := &TokenInfo{Symbol: "BONK", Mint: testBonkMint, Decimals: 5}
+	wif := &TokenInfo{Symbol: "WIF", Mint: testWifMint, Decimals: 6}
+	sol := QuoteTokenInfo(DefaultQuoteMint)
+
+	tests := []struct {
+		name   string
+		tokens []*TokenInfo
+		filter *PoolFilter
+		want   map[string][]string // Pool IDs by base mint
+	}{
+		{
+			name:   "SOL pairs in both orientations",
+			tokens: []*TokenInfo{bonk},
+			want:   map[string][]string{testBonkMint: {"bonk-sol", "sol-bonk"}},
+		},
+		{
+			name:   "several tokens",
+			tokens: []*TokenInfo{bonk, wif},
+			want:   map[string][]string{testBonkMint: {"bonk-sol", "sol-bonk"}, testWifMint: {"wif-sol"}},
+		},
+		{
+			name:   "any quote",
+			tokens: []*TokenInfo{bonk},
+			filter: &PoolFilter{AnyQuote: true},
+			want:   map[string][]string{testBonkMint: {"bonk-sol", "bonk-usdc", "sol-bonk"}},
+		},
+		{
+			name:   "any quote among quote mints",
+			tokens: []*TokenInfo{bonk},
+			filter: &PoolFilter{AnyQuote: true, QuoteMints: map[string]bool{testUSDCMint: true}},
+			want:   map[string][]string{testBonkMint: {"bonk-usdc"}},
+		},
+		{
+			name:   "pool version",
+			tokens: []*TokenInfo{bonk},
+			filter: &PoolFilter{Versions: map[int]bool{5: true}},
+			want:   map[string][]string{testBonkMint: {"sol-bonk"}},
+		},
+		{
+			name:   "official section only",
+			tokens: []*TokenInfo{bonk},
+			filter: &PoolFilter{Skip: map[string]bool{SectionUnofficial: true}},
+			want:   map[string][]string{testBonkMint: {"bonk-sol"}},
+		},
+		{
+			name:   "market without tokens",
+			filter: &PoolFilter{MarketID: "market-d"},
+			want:   map[string][]string{testWifMint: {"wif-sol"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pools, _, err := ProcessPools(context.Background(), strings.NewReader(testPoolList), tt.tokens, sol, tt.filter)
+			if err != nil {
+				t.Fatalf("ProcessPools() error = %v", err)
+			}
+			got := make(map[string][]string)
+			for mint, list := range pools {
+				for _, pool := range list {
+					got[mint] = append(got[mint], pool.ID)
+				}
+			}
+			for mint, ids := range tt.want {
+				if !slices.Equal(got[mint], ids) {
+					t.Errorf("pools of %s = %v, want %v", mint, got[mint], ids)
+				}
+			}
+			for mint, ids := range got {
+				if _, ok := tt.want[mint]; !ok {
+					t.Errorf("unexpected pools of %s: %v", mint, ids)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessPoolsStats(t *testing.T) {
+	bonk := &TokenInfo{Symbol: "BONK", Mint: testBonkMint}
+	filter := &PoolFilter{Versions: map[int]bool{4: true}}
+	_, stats, err := ProcessPools(context.Background(), strings.NewReader(testPoolList), []*TokenInfo{bonk}, QuoteTokenInfo(DefaultQuoteMint), filter)
+	if err != nil {
+		t.Fatalf("ProcessPools() error = %v", err)
+	}
+	if stats.OfficialPools != 2 || stats.UnofficialPools != 2 {
+		t.Errorf("counted %d official and %d unofficial pools, want 2 and 2", stats.OfficialPools, stats.UnofficialPools)
+	}
+	if stats.MatchedPools != 1 || stats.FilteredPools != 1 {
+		t.Errorf("matched %d and filtered %d pools, want 1 and 1", stats.MatchedPools, stats.FilteredPools)
+	}
+	if stats.BytesRead != int64(len(testPoolList)) {
+		t.Errorf("BytesRead = %d, want %d", stats.BytesRead, len(testPoolList))
+	}
+}
+
+func TestProcessPoolsCountOnly(t *testing.T) {
+	pools, stats, err := ProcessPools(context.Background(), strings.NewReader(testPoolList), nil, nil, &PoolFilter{CountOnly: true})
+	if err != nil {
+		t.Fatalf("ProcessPools() error = %v", err)
+	}
+	if len(pools) != 0 {
+		t.Errorf("got pools %v, want none", pools)
+	}
+	if stats.OfficialPools != 2 || stats.UnofficialPools != 2 {
+		t.Errorf("counted %d official and %d unofficial pools, want 2 and 2", stats.OfficialPools, stats.UnofficialPools)
+	}
+}
+
+func TestProcessPoolsUnknownFields(t *testing.T) {
+	wif := &TokenInfo{Symbol: "WIF", Mint: testWifMint}
+	sol := QuoteTokenInfo(DefaultQuoteMint)
+
+	tests := []struct {
+		name      string
+		filter    *PoolFilter
+		wantExtra bool
+		wantErr   bool
+	}{
+		{name: "dropped by default", filter: &PoolFilter{}},
+		{name: "kept", filter: &PoolFilter{KeepUnknownFields: true}, wantExtra: true},
+		{name: "strict schema", filter: &PoolFilter{StrictSchema: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pools, _, err := ProcessPools(context.Background(), strings.NewReader(testPoolList), []*TokenInfo{wif}, sol, tt.filter)
+			if tt.wantErr {
+				var validation *ValidationError
+				if !errors.As(err, &validation) {
+					t.Fatalf("ProcessPools() error = %v, want a *ValidationError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessPools() error = %v", err)
+			}
+			if len(pools[testWifMint]) != 1 {
+				t.Fatalf("got %d WIF pools, want 1", len(pools[testWifMint]))
+			}
+			extra := pools[testWifMint][0].Extra
+			if hasExtra := extra["lpVault"] != nil; hasExtra != tt.wantExtra {
+				t.Errorf("Extra = %v, want lpVault kept %v", extra, tt.wantExtra)
+			}
+		})
+	}
+}
+
+func TestProcessPoolsMalformed(t *testing.T) {
+	bonk := &TokenInfo{Symbol: "BONK", Mint: testBonkMint}
+	tests := []struct {
+		name string
+		list string
+	}{
+		{name: "truncated", list: testPoolList[:len(testPoolList)/2]},
+		{name: "section not an array", list: `{"official":{}}`},
+		{name: "mistyped field", list: `{"official":[{"id":"x","baseMint":1}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ProcessPools(context.Background(), strings.NewReader(tt.list), []*TokenInfo{bonk}, QuoteTokenInfo(DefaultQuoteMint), nil)
+			if err == nil {
+				t.Fatal("ProcessPools() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func BenchmarkProcessPools(b *testing.B) {
+	// A pool list of 2,000 WIF/SOL pools, each with a field RaydiumPool does
+	// not know about
+	var list strings.Builder
+	list.WriteString(`{"official":[`)
+	for i := 0; i < 2000; i++ {
+		if i > 0 {
+			list.WriteByte(',')
+		}
+		fmt.Fprintf(&list, `{"id":"pool-%d","baseMint":"%s","quoteMint":"%s","version":4,"baseDecimals":6,"quoteDecimals":9,"lpVault":"vault-%d"}`, i, testWifMint, DefaultQuoteMint, i)
+	}
+	list.WriteString(`],"unOfficial":[]}`)
+	data := list.String()
+	wif := &TokenInfo{Symbol: "WIF", Mint: testWifMint}
+
+	for _, bb := range []struct {
+		name   string
+		filter *PoolFilter
+	}{
+		{name: "unknown fields dropped", filter: &PoolFilter{}},
+		{name: "unknown fields kept", filter: &PoolFilter{KeepUnknownFields: true}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := ProcessPools(context.Background(), strings.NewReader(data), []*TokenInfo{wif}, QuoteTokenInfo(DefaultQuoteMint), bb.filter); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,543 @@
+package pooltrim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RPCClient queries a Solana JSON-RPC endpoint in batches
+type RPCClient struct {
+	Client            *http.Client
+	URL               string
+	BatchSize         int           // Requests per batch, 0 sends a single batch
+	RequestsPerSecond float64       // Batches sent per second, 0 disables the limit
+	Concurrency       int           // Batches in flight at once, 0 or 1 sends them one by one
+	MaxRetries        int           // Times a rate limited (429) batch is retried
+	Cache             *BalanceCache // Reused balances, nil queries every account
+}
+
+// BalanceCache stores token account balances on disk, keyed by account, so
+// runs within the TTL reuse them instead of querying the RPC endpoint again
+type BalanceCache struct {
+	Path    string
+	TTL     time.Duration
+	Refresh bool // Ignore cached balances, still storing the fetched ones
+	entries map[string]cachedBalance
+}
+
+// cachedBalance is a balance with the time it was fetched
+type cachedBalance struct {
+	Amount    float64   `json:"amount"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// NewBalanceCache returns a balance cache in the user cache directory
+func NewBalanceCache(ttl time.Duration, refresh bool) (*BalanceCache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate user cache directory: %w", err)
+	}
+	return &BalanceCache{Path: filepath.Join(dir, cacheName, BalancesCacheFile), TTL: ttl, Refresh: refresh}, nil
+}
+
+// load reads the cache file once. A missing or unreadable file leaves the
+// cache empty
+func (c *BalanceCache) load() {
+	if c.entries != nil {
+		return
+	}
+	c.entries = make(map[string]cachedBalance)
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		warnf("⚠️  Ignoring unreadable balance cache %s: %v\n", c.Path, err)
+		c.entries = make(map[string]cachedBalance)
+	}
+}
+
+// lookup returns the cached balances younger than the TTL and the accounts
+// that still have to be fetched
+func (c *BalanceCache) lookup(accounts []string) (map[string]float64, []string) {
+	c.load()
+	cached := make(map[string]float64)
+	var missing []string
+	for _, account := range accounts {
+		entry, ok := c.entries[account]
+		if ok && !c.Refresh && time.Since(entry.FetchedAt) < c.TTL {
+			cached[account] = entry.Amount
+			continue
+		}
+		missing = append(missing, account)
+	}
+	return cached, missing
+}
+
+// store records freshly fetched balances, drops expired ones and writes the
+// cache file
+func (c *BalanceCache) store(balances map[string]float64) error {
+	c.load()
+	now := time.Now()
+	for account, amount := range balances {
+		c.entries[account] = cachedBalance{Amount: amount, FetchedAt: now}
+	}
+	for account, entry := range c.entries {
+		if now.Sub(entry.FetchedAt) >= c.TTL {
+			delete(c.entries, account)
+		}
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode balance cache: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return WriteFileAtomic(c.Path, data)
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// tokenAccountBalance is the result of getTokenAccountBalance
+type tokenAccountBalance struct {
+	Value struct {
+		UIAmountString string `json:"uiAmountString"`
+	} `json:"value"`
+}
+
+// maxMultipleAccounts is the most accounts a getMultipleAccounts call takes
+const maxMultipleAccounts = 100
+
+// multipleAccounts is the result of getMultipleAccounts, with a nil entry
+// for each account that does not exist
+type multipleAccounts struct {
+	Value []*struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"value"`
+}
+
+// parsedTokenAccount is the data of an SPL token account in jsonParsed
+// encoding
+type parsedTokenAccount struct {
+	Parsed struct {
+		Info struct {
+			TokenAmount struct {
+				UIAmountString string `json:"uiAmountString"`
+			} `json:"tokenAmount"`
+		} `json:"info"`
+	} `json:"parsed"`
+}
+
+// TokenAccountBalances returns the balance of each token account in token
+// units. Accounts the node reports errors for are left out of the result.
+// Balances found in the cache are not queried, and fetched ones are added to it
+func (c *RPCClient) TokenAccountBalances(ctx context.Context, accounts []string) (map[string]float64, error) {
+	balances := make(map[string]float64, len(accounts))
+	if c.Cache != nil {
+		var cached map[string]float64
+		cached, accounts = c.Cache.lookup(accounts)
+		for account, amount := range cached {
+			balances[account] = amount
+		}
+		if len(cached) > 0 {
+			logf("♻️  Using %d cached balances, fetching %d\n", len(cached), len(accounts))
+		}
+	}
+	fetched := make(map[string]float64, len(accounts))
+
+	batchSize := c.BatchSize
+	if batchSize <= 0 {
+		batchSize = max(len(accounts), 1)
+	}
+	var batches [][]string
+	for start := 0; start < len(accounts); start += batchSize {
+		batches = append(batches, accounts[start:min(start+batchSize, len(accounts))])
+	}
+
+	// Workers share the rate limit, and the first error stops the others
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limiter := newRateLimiter(c.RequestsPerSecond)
+	jobs := make(chan []string)
+	var mu sync.Mutex
+	var firstErr error
+	var failed, done int
+	var wg sync.WaitGroup
+	for range max(1, min(c.Concurrency, len(batches))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				results, batchFailed, err := c.fetchBatch(ctx, limiter, batch)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				for account, amount := range results {
+					balances[account] = amount
+					fetched[account] = amount
+				}
+				failed += batchFailed
+				done += len(batch)
+				progressf("Fetched %d/%d balances...", done, len(accounts))
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, batch := range batches {
+		select {
+		case jobs <- batch:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(accounts) > 0 {
+		progressDonef("Fetched %d balances, %d failed    \n", len(fetched), failed)
+	}
+
+	if c.Cache != nil && len(fetched) > 0 {
+		if err := c.Cache.store(fetched); err != nil {
+			warnf("⚠️  Failed to update balance cache: %v\n", err)
+		}
+	}
+	return balances, nil
+}
+
+// fetchBatch queries the balances of one batch of accounts, returning them
+// with the number of accounts that have no balance. The accounts are read
+// with getMultipleAccounts, falling back to one getTokenAccountBalance
+// request per account when that fails
+func (c *RPCClient) fetchBatch(ctx context.Context, limiter *rateLimiter, batch []string) (map[string]float64, int, error) {
+	balances, failed, err := c.fetchAccounts(ctx, limiter, batch)
+	if err == nil {
+		return balances, failed, nil
+	}
+	var statusErr *StatusError
+	if ctx.Err() != nil || errors.As(err, &statusErr) && statusErr.Code == http.StatusTooManyRequests {
+		return nil, 0, err
+	}
+	warnf("⚠️  getMultipleAccounts failed, falling back to single balance requests: %v\n", err)
+	return c.fetchBalances(ctx, limiter, batch)
+}
+
+// fetchAccounts reads the token balances of a batch of accounts with one
+// getMultipleAccounts request per 100 accounts, sent together
+func (c *RPCClient) fetchAccounts(ctx context.Context, limiter *rateLimiter, batch []string) (map[string]float64, int, error) {
+	var chunks [][]string
+	var requests []rpcRequest
+	for start := 0; start < len(batch); start += maxMultipleAccounts {
+		chunk := batch[start:min(start+maxMultipleAccounts, len(batch))]
+		requests = append(requests, rpcRequest{
+			JSONRPC: "2.0",
+			ID:      len(chunks),
+			Method:  "getMultipleAccounts",
+			Params:  []any{chunk, map[string]string{"encoding": "jsonParsed"}},
+		})
+		chunks = append(chunks, chunk)
+	}
+	debugf("\nSending %d getMultipleAccounts requests for %d accounts\n", len(requests), len(batch))
+	responses, err := c.callWithRetry(ctx, limiter, requests)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(responses) != len(requests) {
+		return nil, 0, fmt.Errorf("expected %d responses, got %d", len(requests), len(responses))
+	}
+
+	balances := make(map[string]float64, len(batch))
+	failed := 0
+	for _, resp := range responses {
+		if resp.ID < 0 || resp.ID >= len(chunks) {
+			return nil, 0, fmt.Errorf("unexpected response ID %d", resp.ID)
+		}
+		if resp.Error != nil {
+			return nil, 0, fmt.Errorf("RPC error %d: %s", resp.Error.Code, resp.Error.Message)
+		}
+		chunk := chunks[resp.ID]
+
+		var result multipleAccounts
+		if err := json.Unmarshal(resp.Result, &result); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode accounts: %w", err)
+		}
+		if len(result.Value) != len(chunk) {
+			return nil, 0, fmt.Errorf("expected %d accounts, got %d", len(chunk), len(result.Value))
+		}
+
+		for i, account := range result.Value {
+			if account == nil {
+				warnf("⚠️  Failed to get balance of %s: account not found\n", chunk[i])
+				failed++
+				continue
+			}
+			// Accounts that are not token accounts come back as raw data
+			var data parsedTokenAccount
+			amount := ""
+			if json.Unmarshal(account.Data, &data) == nil {
+				amount = data.Parsed.Info.TokenAmount.UIAmountString
+			}
+			if amount == "" {
+				warnf("⚠️  Failed to get balance of %s: not a token account\n", chunk[i])
+				failed++
+				continue
+			}
+			balance, err := strconv.ParseFloat(amount, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid balance %q for %s: %w", amount, chunk[i], err)
+			}
+			balances[chunk[i]] = balance
+		}
+	}
+	return balances, failed, nil
+}
+
+// fetchBalances queries the balance of each account of a batch with its own
+// getTokenAccountBalance request, sent together
+func (c *RPCClient) fetchBalances(ctx context.Context, limiter *rateLimiter, batch []string) (map[string]float64, int, error) {
+	requests := make([]rpcRequest, len(batch))
+	for i, account := range batch {
+		requests[i] = rpcRequest{JSONRPC: "2.0", ID: i, Method: "getTokenAccountBalance", Params: []any{account}}
+	}
+	debugf("\nSending batch of %d balance requests\n", len(requests))
+	responses, err := c.callWithRetry(ctx, limiter, requests)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	balances := make(map[string]float64, len(batch))
+	failed := 0
+	for _, resp := range responses {
+		if resp.ID < 0 || resp.ID >= len(batch) {
+			continue
+		}
+		account := batch[resp.ID]
+		if resp.Error != nil {
+			warnf("⚠️  Failed to get balance of %s: %s\n", account, resp.Error.Message)
+			failed++
+			continue
+		}
+
+		var result tokenAccountBalance
+		if err := json.Unmarshal(resp.Result, &result); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode balance of %s: %w", account, err)
+		}
+		amount, err := strconv.ParseFloat(result.Value.UIAmountString, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid balance %q for %s: %w", result.Value.UIAmountString, account, err)
+		}
+		balances[account] = amount
+	}
+	return balances, failed, nil
+}
+
+// callWithRetry sends a batch once the rate limit allows it, retrying with
+// exponential backoff, or the delay of a Retry-After header, while the
+// endpoint answers 429 Too Many Requests
+func (c *RPCClient) callWithRetry(ctx context.Context, limiter *rateLimiter, requests []rpcRequest) ([]rpcResponse, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if err := limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		responses, err := c.call(ctx, requests)
+		var statusErr *StatusError
+		if err == nil || attempt >= c.MaxRetries || !errors.As(err, &statusErr) || statusErr.Code != http.StatusTooManyRequests {
+			return responses, err
+		}
+
+		delay := backoff
+		if statusErr.RetryAfter > 0 {
+			delay = statusErr.RetryAfter
+		}
+		warnf("⚠️  RPC endpoint is rate limiting (attempt %d/%d), retrying in %s\n", attempt+1, c.MaxRetries+1, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// rateLimiter spaces requests shared by several goroutines evenly, a token
+// bucket holding a single token
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // Zero disables the limit
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter allowing perSecond requests per second,
+// or any rate when perSecond is 0
+func newRateLimiter(perSecond float64) *rateLimiter {
+	l := &rateLimiter{}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// wait blocks until the next request may be sent or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	at := time.Now()
+	if l.next.After(at) {
+		at = l.next
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call sends a batch of JSON-RPC requests and returns the responses
+func (c *RPCClient) call(ctx context.Context, requests []rpcRequest) ([]rpcResponse, error) {
+	body, err := json.Marshal(requests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode RPC request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create RPC request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("RPC request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &StatusError{Code: resp.StatusCode}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			statusErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, statusErr
+	}
+
+	var responses []rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		return nil, fmt.Errorf("failed to decode RPC response: %w", err)
+	}
+	return responses, nil
+}
+
+// FetchReserves sets the base and quote reserves of every pool from the
+// on-chain balances of its vaults
+func (c *RPCClient) FetchReserves(ctx context.Context, poolsByMint map[string][]RaydiumPool) error {
+	var accounts []string
+	for _, pools := range poolsByMint {
+		for _, pool := range pools {
+			accounts = append(accounts, pool.BaseVault, pool.QuoteVault)
+		}
+	}
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	logf("\n💧 Fetching reserves for %d vaults from %s\n", len(accounts), c.URL)
+	balances, err := c.TokenAccountBalances(ctx, accounts)
+	if err != nil {
+		return fmt.Errorf("failed to fetch vault balances: %w", err)
+	}
+
+	for _, pools := range poolsByMint {
+		for i := range pools {
+			if balance, ok := balances[pools[i].BaseVault]; ok {
+				pools[i].BaseReserve = &balance
+			}
+			if balance, ok := balances[pools[i].QuoteVault]; ok {
+				pools[i].QuoteReserve = &balance
+			}
+		}
+	}
+	return nil
+}
+
+// reserves returns the reserves of the pool on the side of the token with
+// baseMint and on the other side, which may be either vault depending on
+// the pool's orientation
+func (p RaydiumPool) reserves(baseMint string) (base, quote *float64) {
+	if p.QuoteMint == baseMint {
+		return p.QuoteReserve, p.BaseReserve
+	}
+	return p.BaseReserve, p.QuoteReserve
+}
+
+// AttachPrices sets the spot price of every pool with known, non-zero
+// reserves, in quote tokens per base token regardless of the pool's
+// orientation. Pools are keyed by the mint of their base token
+func AttachPrices(poolsByMint map[string][]RaydiumPool) {
+	for mint, pools := range poolsByMint {
+		for i := range pools {
+			base, quote := pools[i].reserves(mint)
+			if quote == nil || base == nil || *quote == 0 || *base == 0 {
+				continue
+			}
+			price := *quote / *base
+			pools[i].Price = &price
+		}
+	}
+}
+
+// FilterByLiquidity removes pools whose quote-side reserve is below
+// minReserve, including pools whose reserves are unknown, and returns how
+// many were removed. Pools are keyed by the mint of their base token
+func FilterByLiquidity(poolsByMint map[string][]RaydiumPool, minReserve float64) int {
+	removed := 0
+	for mint, pools := range poolsByMint {
+		kept := pools[:0]
+		for _, pool := range pools {
+			if _, reserve := pool.reserves(mint); reserve != nil && *reserve >= minReserve {
+				kept = append(kept, pool)
+			} else {
+				removed++
+			}
+		}
+		poolsByMint[mint] = kept
+	}
+	return removed
+}
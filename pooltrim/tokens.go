@@ -0,0 +1,494 @@
+package pooltrim
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// QuoteTokenInfo returns the token info for a quote mint, falling back to
+// the mint address itself as the symbol when the mint is not well known
+func QuoteTokenInfo(mint string) *TokenInfo {
+	if token, ok := KnownQuoteTokens[mint]; ok {
+		return &token
+	}
+	return &TokenInfo{
+		Symbol: mint,
+		Name:   fmt.Sprintf("%s (Direct Mint)", mint),
+		Mint:   mint,
+	}
+}
+
+// maxSymbolLength caps the length of a sanitized symbol
+const maxSymbolLength = 32
+
+// SanitizeSymbol makes a token symbol safe to use as a file name or
+// identifier. Characters other than ASCII letters, digits, '-' and '_' become
+// '_', runs of '_' are collapsed and the result is trimmed to
+// maxSymbolLength. It returns "" when no letter or digit is left. The raw
+// symbol is kept everywhere else, such as in TokenInfo.Symbol
+func SanitizeSymbol(symbol string) string {
+	var b strings.Builder
+	for _, r := range symbol {
+		if r >= 0x80 || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-') {
+			r = '_'
+		}
+		if r == '_' && strings.HasSuffix(b.String(), "_") {
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	sanitized := b.String()
+	if len(sanitized) > maxSymbolLength {
+		sanitized = sanitized[:maxSymbolLength]
+	}
+	sanitized = strings.Trim(sanitized, "_-")
+	if !strings.ContainsFunc(sanitized, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		return ""
+	}
+	return sanitized
+}
+
+// LooksLikeMint reports whether value has the shape of a base58 Solana address
+func LooksLikeMint(value string) bool {
+	if len(value) < 32 || len(value) > 44 {
+		return false
+	}
+	for _, c := range value {
+		if !strings.ContainsRune(base58Alphabet, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeBase58 decodes a base58 string using the Bitcoin alphabet used by Solana
+func decodeBase58(value string) ([]byte, error) {
+	var decoded []byte // Big-endian
+	for _, c := range value {
+		digit := strings.IndexRune(base58Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+
+		carry := digit
+		for i := len(decoded) - 1; i >= 0; i-- {
+			carry += int(decoded[i]) * 58
+			decoded[i] = byte(carry)
+			carry >>= 8
+		}
+		for ; carry > 0; carry >>= 8 {
+			decoded = append([]byte{byte(carry)}, decoded...)
+		}
+	}
+
+	// Each leading '1' encodes a zero byte
+	for _, c := range value {
+		if c != '1' {
+			break
+		}
+		decoded = append([]byte{0}, decoded...)
+	}
+	return decoded, nil
+}
+
+// ValidateMint checks that mint is a base58 encoded 32-byte Solana address
+func ValidateMint(mint string) error {
+	decoded, err := decodeBase58(mint)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", mint, err)
+	}
+	if len(decoded) != 32 {
+		return fmt.Errorf("invalid address %q: decodes to %d bytes, expected 32", mint, len(decoded))
+	}
+	return nil
+}
+
+// ReadWatchlist reads tickers and mint addresses from a watchlist file. Each
+// line holds a ticker, or a mint optionally followed by its ticker; empty
+// lines and # comments are ignored. Mints are returned with only their
+// symbol and mint set, for the caller to complete from the token list
+func ReadWatchlist(path string) ([]string, []*TokenInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open watchlist: %w", err)
+	}
+	defer file.Close()
+
+	var tickers []string
+	var mints []*TokenInfo
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if !LooksLikeMint(fields[0]) {
+			tickers = append(tickers, fields[0])
+			continue
+		}
+
+		symbol := fields[0]
+		if len(fields) > 1 {
+			symbol = fields[1]
+		}
+		mints = append(mints, &TokenInfo{Symbol: symbol, Mint: fields[0]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read watchlist: %w", err)
+	}
+
+	return tickers, mints, nil
+}
+
+// ValidateTokenJSON checks that a token list file is a complete JSON object
+// with official and unofficial token arrays
+func ValidateTokenJSON(filePath string) error {
+	file, err := OpenJSONFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open token file for validation: %w", err)
+	}
+	defer file.Close()
+
+	var response TokenListResponse
+	if err := json.NewDecoder(file).Decode(&response); err != nil {
+		return fmt.Errorf("invalid token JSON structure: %w", err)
+	}
+
+	if response.Official == nil {
+		return fmt.Errorf("invalid token JSON: missing official tokens array")
+	}
+	if response.Unofficial == nil {
+		return fmt.Errorf("invalid token JSON: missing unOfficial tokens array")
+	}
+	if len(response.Official) == 0 {
+		return fmt.Errorf("invalid token JSON: empty official tokens array")
+	}
+
+	logf("✅ Token JSON validation successful: found %d official and %d unofficial tokens\n", len(response.Official), len(response.Unofficial))
+	return nil
+}
+
+// ResolveTokenFile returns the token list path to use, downloading the list
+// from tokensURL, usually RaydiumTokensURL, when no file is provided
+func ResolveTokenFile(ctx context.Context, dl *Downloader, cache *FileCache, tokenFile, tokensURL string) (string, error) {
+	if tokenFile != "" {
+		if !FileExists(tokenFile) {
+			return "", fmt.Errorf("token file does not exist: %s", tokenFile)
+		}
+		logf("Using provided token file: %s\n", tokenFile)
+		if err := ValidateTokenJSON(tokenFile); err != nil {
+			return "", err
+		}
+		return tokenFile, nil
+	}
+
+	jsonFilePath, err := cache.Fetch(ctx, dl, tokensURL, TokensCacheFile, "", ValidateTokenJSON)
+	if err != nil {
+		return "", fmt.Errorf("failed to download token list: %w", err)
+	}
+	return jsonFilePath, nil
+}
+
+// maxSuggestions caps the number of similar tokens suggested for a symbol
+// that is not found
+const maxSuggestions = 5
+
+// TokenNotFoundError reports a symbol missing from the token list, with the
+// most similar tokens as suggestions
+type TokenNotFoundError struct {
+	Symbol      string
+	Suggestions []*TokenInfo
+}
+
+func (e *TokenNotFoundError) Error() string {
+	return fmt.Sprintf("token %s not found", e.Symbol)
+}
+
+// TokenMap is a token list decoded once and indexed by symbol and mint, so
+// repeated lookups do not rescan the file
+type TokenMap struct {
+	tokens   []mappedToken
+	bySymbol map[string][]int // Indexes into tokens by uppercase symbol
+	byMint   map[string]int   // Index of the first token listed with a mint
+}
+
+// mappedToken is a token with the token list section it was read from
+type mappedToken struct {
+	info    TokenInfo
+	section string
+}
+
+// LoadTokenMap reads the whole token list file into a TokenMap. With strict,
+// a token with a field outside tokenListFields fails with a
+// *ValidationError, like PoolFilter.StrictSchema for pools
+func LoadTokenMap(jsonFilePath string, strict bool) (*TokenMap, error) {
+	m := &TokenMap{
+		bySymbol: make(map[string][]int),
+		byMint:   make(map[string]int),
+	}
+	err := scanTokens(jsonFilePath, strict, func(token *TokenInfo, section string) {
+		i := len(m.tokens)
+		m.tokens = append(m.tokens, mappedToken{info: *token, section: section})
+		symbol := strings.ToUpper(token.Symbol)
+		m.bySymbol[symbol] = append(m.bySymbol[symbol], i)
+		if _, ok := m.byMint[token.Mint]; !ok {
+			m.byMint[token.Mint] = i
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// found logs and returns a copy of the token at index i
+func (m *TokenMap) found(i int) *TokenInfo {
+	token := m.tokens[i].info
+	logf("\n✅ Found %s token (%s):\n", token.Symbol, m.tokens[i].section)
+	logf("  Name: %s\n", token.Name)
+	logf("  Mint: %s\n", token.Mint)
+	logf("  Decimals: %d\n", token.Decimals)
+	return &token
+}
+
+// Lookup returns the tokens matching a symbol, ignoring case. When nothing
+// matches, the returned *TokenNotFoundError suggests the closest symbols
+func (m *TokenMap) Lookup(symbol string) ([]*TokenInfo, error) {
+	symbol = strings.ToUpper(strings.TrimPrefix(symbol, "$"))
+
+	var matchingTokens []*TokenInfo
+	for _, i := range m.bySymbol[symbol] {
+		matchingTokens = append(matchingTokens, m.found(i))
+	}
+	if len(matchingTokens) > 0 {
+		return matchingTokens, nil
+	}
+
+	type candidate struct {
+		token    TokenInfo
+		distance int
+	}
+	var candidates []candidate
+	maxDistance := max(1, len(symbol)/3)
+	for _, mapped := range m.tokens {
+		other := strings.ToUpper(mapped.info.Symbol)
+		distance := levenshtein(symbol, other)
+		if other != "" && (distance <= maxDistance || strings.Contains(other, symbol) || strings.Contains(symbol, other)) {
+			candidates = append(candidates, candidate{token: mapped.info, distance: distance})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+	notFound := &TokenNotFoundError{Symbol: symbol}
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		notFound.Suggestions = append(notFound.Suggestions, &candidates[i].token)
+	}
+	return nil, notFound
+}
+
+// LookupExact returns the tokens whose symbol is exactly the uppercased
+// symbol, without suggestions
+func (m *TokenMap) LookupExact(symbol string) ([]*TokenInfo, error) {
+	symbol = strings.ToUpper(strings.TrimPrefix(symbol, "$"))
+	var matchingTokens []*TokenInfo
+	for _, i := range m.bySymbol[symbol] {
+		if m.tokens[i].info.Symbol == symbol {
+			matchingTokens = append(matchingTokens, m.found(i))
+		}
+	}
+	if len(matchingTokens) == 0 {
+		return nil, &TokenNotFoundError{Symbol: symbol}
+	}
+	return matchingTokens, nil
+}
+
+// LookupMint returns the token with the given mint
+func (m *TokenMap) LookupMint(mint string) (*TokenInfo, error) {
+	i, ok := m.byMint[mint]
+	if !ok {
+		return nil, fmt.Errorf("mint %s not found", mint)
+	}
+	return m.found(i), nil
+}
+
+// Mint returns the token with the given mint without logging it. A nil
+// TokenMap holds no tokens
+func (m *TokenMap) Mint(mint string) (TokenInfo, bool) {
+	if m == nil {
+		return TokenInfo{}, false
+	}
+	i, ok := m.byMint[mint]
+	if !ok {
+		return TokenInfo{}, false
+	}
+	return m.tokens[i].info, true
+}
+
+// SearchName returns the tokens whose name contains substring, ignoring case
+func (m *TokenMap) SearchName(substring string) ([]*TokenInfo, error) {
+	substring = strings.ToLower(substring)
+	var matchingTokens []*TokenInfo
+	for i, mapped := range m.tokens {
+		if strings.Contains(strings.ToLower(mapped.info.Name), substring) {
+			matchingTokens = append(matchingTokens, m.found(i))
+		}
+	}
+	if len(matchingTokens) == 0 {
+		return nil, fmt.Errorf("no token name contains %q", substring)
+	}
+	return matchingTokens, nil
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// tokenListFields are the JSON names of the token list fields, including
+// those the tool does not use
+var tokenListFields = map[string]bool{
+	"symbol": true, "name": true, "mint": true, "decimals": true,
+	"icon": true, "extensions": true,
+}
+
+// decodeStrictToken decodes a token, failing with a *ValidationError naming
+// the token on a field outside tokenListFields
+func decodeStrictToken(data []byte, token *TokenInfo) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, token); err != nil {
+		return err
+	}
+	var unknown []string
+	for _, name := range sortedKeys(fields) {
+		if !tokenListFields[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return &ValidationError{Err: fmt.Errorf("token %s (%s): unknown fields %s", token.Symbol, token.Mint, strings.Join(unknown, ", "))}
+	}
+	return nil
+}
+
+// scanTokens streams the token list file, passing each token to visit with
+// the section it is listed in. With strict, tokens are decoded with
+// decodeStrictToken
+func scanTokens(jsonFilePath string, strict bool, visit func(token *TokenInfo, section string)) error {
+	file, err := OpenJSONFile(jsonFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	t, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read opening token: %w", err)
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected object start, got %v", t)
+	}
+
+	tokenCount := 0
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read field name: %w", err)
+		}
+
+		if keyStr, ok := key.(string); ok {
+			switch keyStr {
+			case SectionOfficial, SectionUnofficial:
+				t, err := decoder.Token()
+				if err != nil {
+					return fmt.Errorf("failed to read array start: %w", err)
+				}
+				if delim, ok := t.(json.Delim); !ok || delim != '[' {
+					return fmt.Errorf("expected array start for %s, got %v", keyStr, t)
+				}
+
+				for decoder.More() {
+					tokenCount++
+					if tokenCount%100 == 0 {
+						progressf("Processed %d tokens...", tokenCount)
+					}
+
+					var token TokenInfo
+					if strict {
+						var raw json.RawMessage
+						if err := decoder.Decode(&raw); err != nil {
+							return fmt.Errorf("failed to decode token: %w", err)
+						}
+						if err := decodeStrictToken(raw, &token); err != nil {
+							return fmt.Errorf("failed to decode token: %w", err)
+						}
+					} else if err := decoder.Decode(&token); err != nil {
+						return fmt.Errorf("failed to decode token: %w", err)
+					}
+
+					visit(&token, keyStr)
+				}
+
+				t, err = decoder.Token()
+				if err != nil {
+					return fmt.Errorf("failed to read array end: %w", err)
+				}
+				if delim, ok := t.(json.Delim); !ok || delim != ']' {
+					return fmt.Errorf("expected array end for %s, got %v", keyStr, t)
+				}
+			default:
+				// Values such as the list version may be objects
+				var raw json.RawMessage
+				if err := decoder.Decode(&raw); err != nil {
+					return fmt.Errorf("failed to skip value: %w", err)
+				}
+			}
+		}
+	}
+
+	t, err = decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read closing token: %w", err)
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '}' {
+		return fmt.Errorf("expected object end, got %v", t)
+	}
+
+	logf("\nProcessed %d tokens total\n", tokenCount)
+	return nil
+}
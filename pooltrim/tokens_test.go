@@ -0,0 +1,156 @@
+package pooltrim
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBase58(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []byte
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "1", want: []byte{0}},
+		{value: "11", want: []byte{0, 0}},
+		{value: "2", want: []byte{1}},
+		{value: "z", want: []byte{57}},
+		{value: "21", want: []byte{58}},
+		{value: "5R", want: []byte{1, 0}},
+		{value: "15R", want: []byte{0, 1, 0}},
+		{value: "0", wantErr: true},
+		{value: "O", wantErr: true},
+		{value: "I", wantErr: true},
+		{value: "l", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := decodeBase58(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("decodeBase58(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !bytes.Equal(got, tt.want) {
+			t.Errorf("decodeBase58(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestValidateMint(t *testing.T) {
+	tests := []struct {
+		name    string
+		mint    string
+		wantErr string
+	}{
+		{name: "SOL", mint: DefaultQuoteMint},
+		{name: "USDC", mint: "EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v"},
+		{name: "empty", mint: "", wantErr: "decodes to 0 bytes"},
+		{name: "too short", mint: "So1111", wantErr: "expected 32"},
+		{name: "too long", mint: DefaultQuoteMint + "zz", wantErr: "expected 32"},
+		{name: "not base58", mint: "So11111111111111111111111111111111111111110", wantErr: "invalid base58 character"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMint(tt.mint)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateMint(%q) = %v, want nil", tt.mint, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ValidateMint(%q) = %v, want error containing %q", tt.mint, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeSymbol(t *testing.T) {
+	tests := []struct {
+		symbol string
+		want   string
+	}{
+		{"BONK", "BONK"},
+		{"my-token", "my-token"},
+		{"$WIF", "WIF"},
+		{"a b c", "a_b_c"},
+		{"a  /  b", "a_b"},
+		{"🐶DOG", "DOG"},
+		{"ÉTH", "TH"},
+		{"../etc", "etc"},
+		{"---", ""},
+		{"...", ""},
+		{"", ""},
+		{strings.Repeat("A", 40), strings.Repeat("A", 32)},
+	}
+	for _, tt := range tests {
+		if got := SanitizeSymbol(tt.symbol); got != tt.want {
+			t.Errorf("SanitizeSymbol(%q) = %q, want %q", tt.symbol, got, tt.want)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"BONK", "BONK", 0},
+		{"BONK", "BONC", 1},
+		{"BONK", "BONKS", 1},
+		{"WIF", "WFI", 2},
+		{"kitten", "sitting", 3},
+		{"né", "ne", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLoadTokenMapStrict(t *testing.T) {
+	const bonk = `"symbol":"BONK","name":"Bonk","mint":"` + testBonkMint + `","decimals":5`
+	tests := []struct {
+		name    string
+		token   string
+		strict  bool
+		wantErr bool
+	}{
+		{name: "known fields", token: `{` + bonk + `}`, strict: true},
+		{name: "icon and extensions", token: `{` + bonk + `,"icon":"https://example.com/bonk.png","extensions":{"coingeckoId":"bonk"}}`, strict: true},
+		{name: "unknown field", token: `{` + bonk + `,"hasFreeze":1}`, strict: true, wantErr: true},
+		{name: "unknown field without strict", token: `{` + bonk + `,"hasFreeze":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens.json")
+			list := `{"name":"Raydium Token List","official":[` + tt.token + `],"unOfficial":[]}`
+			if err := os.WriteFile(path, []byte(list), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			tokenMap, err := LoadTokenMap(path, tt.strict)
+			if tt.wantErr {
+				var validation *ValidationError
+				if !errors.As(err, &validation) || !strings.Contains(err.Error(), "hasFreeze") {
+					t.Fatalf("LoadTokenMap() error = %v, want a *ValidationError naming hasFreeze", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadTokenMap() error = %v", err)
+			}
+			if token, ok := tokenMap.Mint(testBonkMint); !ok || token.Symbol != "BONK" {
+				t.Errorf("Mint(%s) = %v, %v, want BONK", testBonkMint, token, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Package pooltrim downloads Raydium's liquidity pool and token lists and
+// filters them down to the pools of specific token pairs.
+package pooltrim
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	DefaultQuoteMint = "So11111111111111111111111111111111111111112" // SOL
+	RaydiumURL       = "https://api.raydium.io/v2/sdk/liquidity/mainnet.json"
+	RaydiumTokensURL = "https://api.raydium.io/v2/sdk/token/raydium.mainnet.json"
+
+	// SectionOfficial and SectionUnofficial are the pool list sections
+	SectionOfficial   = "official"
+	SectionUnofficial = "unOfficial"
+)
+
+// KnownQuoteTokens holds metadata for common quote mints so they can be
+// displayed by symbol without a token list lookup
+var KnownQuoteTokens = map[string]TokenInfo{
+	DefaultQuoteMint: {Symbol: "SOL", Name: "Wrapped SOL", Mint: DefaultQuoteMint, Decimals: 9},
+	"EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v": {Symbol: "USDC", Name: "USD Coin", Mint: "EPjFWdd5AufqSSqeM2qN1xzybapC8G4wEGGkZwyTDt1v", Decimals: 6},
+	"Es9vMFrzaCERmJfrF4H2FYD4KCoNkY11McCe8BenwNYB": {Symbol: "USDT", Name: "USDT", Mint: "Es9vMFrzaCERmJfrF4H2FYD4KCoNkY11McCe8BenwNYB", Decimals: 6},
+}
+
+// RaydiumPool represents a Raydium liquidity pool
+type RaydiumPool struct {
+	ID              string `json:"id"`
+	BaseMint        string `json:"baseMint"`
+	QuoteMint       string `json:"quoteMint"`
+	LPMint          string `json:"lpMint"`
+	ProgramID       string `json:"programId"`
+	Authority       string `json:"authority"`
+	OpenOrders      string `json:"openOrders"`
+	TargetOrders    string `json:"targetOrders"`
+	BaseVault       string `json:"baseVault"`
+	QuoteVault      string `json:"quoteVault"`
+	Version         int    `json:"version"`
+	BaseDecimals    int    `json:"baseDecimals"`
+	QuoteDecimals   int    `json:"quoteDecimals"`
+	LPDecimals      int    `json:"lpDecimals"`
+	MarketVersion   int    `json:"marketVersion"`
+	MarketProgramID string `json:"marketProgramId"`
+	MarketID        string `json:"marketId"`
+
+	// Vault balances in token units, only set when reserves are fetched over RPC
+	BaseReserve  *float64 `json:"baseReserve,omitempty"`
+	QuoteReserve *float64 `json:"quoteReserve,omitempty"`
+
+	// Approximate spot price in quote tokens per base token, derived from the reserves
+	Price *float64 `json:"price,omitempty"`
+
+	// Fields of the pool object RaydiumPool does not know about. Pools read
+	// back from the output file keep them, the scan only with
+	// PoolFilter.KeepUnknownFields
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// RaydiumResponse represents the API response structure
+type RaydiumResponse struct {
+	Name       string        `json:"name"`
+	Official   []RaydiumPool `json:"official"`
+	Unofficial []RaydiumPool `json:"unOfficial"`
+}
+
+// TokenInfo represents a token in Raydium's token list
+type TokenInfo struct {
+	Symbol   string `json:"symbol"`
+	Name     string `json:"name"`
+	Mint     string `json:"mint"`
+	Decimals int    `json:"decimals"`
+}
+
+// TokenListResponse represents the token list API response
+type TokenListResponse struct {
+	Official   []TokenInfo `json:"official"`
+	Unofficial []TokenInfo `json:"unOfficial"`
+}
+
+// TokenPoolInfo combines token information with its pools
+type TokenPoolInfo struct {
+	Token TokenInfo     `json:"token"`
+	Quote *TokenInfo    `json:"quote,omitempty"`
+	File  string        `json:"file,omitempty"` // Pool file the entry was filtered from, only set when filtering several
+	Pools []RaydiumPool `json:"pools"`
+}
+
+// QuoteMint returns the quote mint of the entry, treating entries written
+// before quote support as SOL pairs
+func (t TokenPoolInfo) QuoteMint() string {
+	if t.Quote == nil {
+		return DefaultQuoteMint
+	}
+	return t.Quote.Mint
+}
+
+// TokenPoolInfoList represents a list of token and pool information
+type TokenPoolInfoList struct {
+	OutputMetadata
+	Tokens []TokenPoolInfo `json:"tokens"`
+}
+
+// OutputMetadata describes the latest run that wrote an output file. Every
+// field is optional, so files written before it still read
+type OutputMetadata struct {
+	GeneratedAt *time.Time        `json:"generatedAt,omitempty"`
+	Version     string            `json:"version,omitempty"`
+	QuoteMints  []string          `json:"quoteMints,omitempty"` // Empty when any quote token was matched
+	Filters     map[string]string `json:"filters,omitempty"`    // Filter flags given, by flag name
+	Source      *SourceInfo       `json:"source,omitempty"`
+}
+
+// newer reports whether m was generated after other. Metadata without a
+// timestamp is the oldest
+func (m OutputMetadata) newer(other OutputMetadata) bool {
+	if m.GeneratedAt == nil {
+		return false
+	}
+	return other.GeneratedAt == nil || m.GeneratedAt.After(*other.GeneratedAt)
+}
+
+// SourceInfo records which pool list an output was built from: the URL with
+// the ETag and Last-Modified headers of the download, or the local file
+type SourceInfo struct {
+	URL          string `json:"url,omitempty"`
+	File         string `json:"file,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}